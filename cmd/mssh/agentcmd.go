@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	agentpkg "github.com/eznix86/mssh/internal/agent"
+	"github.com/eznix86/mssh/internal/config"
+	"github.com/eznix86/mssh/internal/logging"
+	"github.com/eznix86/mssh/internal/protocol"
+)
+
+// runAgentConfig serves every registration in the agent config at path and
+// reloads it on SIGHUP. A file that fails to load on reload is reported and
+// the running registrations are kept.
+func runAgentConfig(path string, cfg config.Config) {
+	regs, err := loadAgentRegistrations(path, cfg)
+	if err != nil {
+		fatal("agent", err)
+	}
+	logger := logging.Component("agent").With("config", path)
+	sup := agentpkg.NewSupervisor()
+	sup.Apply(regs)
+	logger.Info("serving registrations", "registrations", len(regs))
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		regs, err := loadAgentRegistrations(path, cfg)
+		if err != nil {
+			logger.Error("reload failed, keeping current registrations", logging.Err(err))
+			continue
+		}
+		sup.Apply(regs)
+		logger.Info("reloaded", "registrations", len(regs))
+	}
+}
+
+// loadAgentRegistrations reads the agent config and resolves each entry to
+// agent options. Server, token and TLS fall back to the file's top-level
+// values, then to the mssh config (including the active profile).
+func loadAgentRegistrations(path string, cfg config.Config) ([]agentpkg.Options, error) {
+	file, err := config.LoadAgentFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	regs := make([]agentpkg.Options, 0, len(file.Registrations))
+	for i, reg := range file.Registrations {
+		nodeID := reg.NodeID
+		if nodeID == "" {
+			nodeID = defaultNodeID()
+		}
+		if !protocol.NamePattern.MatchString(nodeID) {
+			return nil, fmt.Errorf("registration %d: invalid node-id %q", i+1, reg.NodeID)
+		}
+		if reg.Service != "" && !protocol.NamePattern.MatchString(reg.Service) {
+			return nil, fmt.Errorf("registration %d: invalid service %q", i+1, reg.Service)
+		}
+		if reg.Target != "" && reg.SSHPort != 0 {
+			return nil, fmt.Errorf("registration %d: set either target or ssh-port", i+1)
+		}
+		allow := reg.Allow
+		if allow == nil {
+			allow = file.Allow
+		}
+		if err := agentpkg.ValidateAllow(allow); err != nil {
+			return nil, fmt.Errorf("registration %d: %w", i+1, err)
+		}
+		tags := mergeTags(file.Tags, reg.Tags)
+		if err := validateTags(tags); err != nil {
+			return nil, fmt.Errorf("registration %d: %w", i+1, err)
+		}
+
+		serverAddr := firstNonEmpty(reg.Server, file.Server, os.Getenv("MSSH_SERVER"), cfg.Agent.Server, cfg.Server, defaultServerAddr)
+		opts, err := agentpkg.ParseServerAddr(serverAddr)
+		if err != nil {
+			return nil, fmt.Errorf("registration %d: invalid server address: %w", i+1, err)
+		}
+		key := serverAddr + " " + nodeID + "/" + reg.Service
+		if seen[key] {
+			return nil, fmt.Errorf("registration %d: %s is registered twice on %s", i+1, agentKeyLabel(nodeID, reg.Service), serverAddr)
+		}
+		seen[key] = true
+
+		tls := reg.TLS
+		if tls == (config.TLSConfig{}) {
+			tls = file.TLS
+		}
+		if tls == (config.TLSConfig{}) {
+			tls = cfg.TLS
+		}
+		opts.NodeID = nodeID
+		opts.Service = reg.Service
+		opts.Target = reg.Target
+		opts.SSHPort = firstNonZero(reg.SSHPort, defaultSSHPort)
+		opts.Token = firstNonEmpty(reg.Token, file.Token, cfg.Token)
+		opts.TLS = transportTLS(tls)
+		opts.Allow = allow
+		opts.Tags = tags
+		opts.Version = version
+		regs = append(regs, opts)
+	}
+	return regs, nil
+}
+
+func agentKeyLabel(nodeID, service string) string {
+	if service == "" {
+		return nodeID
+	}
+	return nodeID + "/" + service
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+
+	"github.com/eznix86/mssh/internal/sshutil"
+)
+
+const (
+	authPublicKey           = "publickey"
+	authKeyboardInteractive = "keyboard-interactive"
+	authPassword            = "password"
+)
+
+// defaultAuthOrder mirrors OpenSSH's PreferredAuthentications default.
+var defaultAuthOrder = []string{authPublicKey, authKeyboardInteractive, authPassword}
+
+// parseAuthOrder validates a list of authentication method names.
+func parseAuthOrder(methods []string) ([]string, error) {
+	var order []string
+	seen := map[string]bool{}
+	for _, method := range methods {
+		method = strings.ToLower(strings.TrimSpace(method))
+		if method == "" || seen[method] {
+			continue
+		}
+		switch method {
+		case authPublicKey, authKeyboardInteractive, authPassword:
+		default:
+			return nil, fmt.Errorf("unknown auth method %q (expected %s, %s or %s)", method, authPublicKey, authKeyboardInteractive, authPassword)
+		}
+		seen[method] = true
+		order = append(order, method)
+	}
+	return order, nil
+}
+
+// buildAuthMethods returns the methods to try in order. Password and
+// keyboard-interactive authentication are refused unless hostKeys verified
+// the host, so secrets are never typed into an impersonated node.
+func buildAuthMethods(opts clientOptions, prompt *bufio.Reader, hostKeys *sshutil.HostKeyChecker) ([]ssh.AuthMethod, func(), error) {
+	var auth []ssh.AuthMethod
+	var cleanup func()
+
+	order := opts.Auth
+	if len(order) == 0 {
+		order = defaultAuthOrder
+	}
+
+	for _, method := range order {
+		switch method {
+		case authPublicKey:
+			methods, agentCleanup := publicKeyMethods(opts.Identities, opts.IdentitiesOnly)
+			auth = append(auth, methods...)
+			if agentCleanup != nil {
+				cleanup = agentCleanup
+			}
+		case authKeyboardInteractive:
+			auth = append(auth, ssh.RetryableAuthMethod(ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				if len(questions) > 0 && !hostKeys.Verified() {
+					return nil, errUnverifiedHost(opts.Node, authKeyboardInteractive)
+				}
+				return keyboardInteractiveChallenge(prompt, name, instruction, questions, echos)
+			}), 3))
+		case authPassword:
+			auth = append(auth, ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+				if !hostKeys.Verified() {
+					return "", errUnverifiedHost(opts.Node, authPassword)
+				}
+				return promptPassword(opts.User, opts.Node)
+			}), 3))
+		}
+	}
+
+	if len(auth) == 0 {
+		return nil, cleanup, fmt.Errorf("no SSH authentication methods available; specify --identity or run ssh-add")
+	}
+
+	return auth, cleanup, nil
+}
+
+func publicKeyMethods(identities []string, identitiesOnly bool) ([]ssh.AuthMethod, func()) {
+	var auth []ssh.AuthMethod
+	var cleanup func()
+
+	candidates := identities
+	if len(candidates) == 0 {
+		candidates = defaultIdentityCandidates()
+	}
+
+	var signers []ssh.Signer
+	var certs []*ssh.Certificate
+	// allowed records the public keys of the configured identities so that
+	// IdentitiesOnly can still use matching keys held by the agent.
+	allowed := map[string]bool{}
+	for _, candidate := range candidates {
+		if candidate == "" {
+			continue
+		}
+		expanded, err := expandPath(candidate)
+		if err != nil {
+			continue
+		}
+		if data, err := os.ReadFile(expanded + ".pub"); err == nil {
+			if pub, _, _, _, err := ssh.ParseAuthorizedKey(data); err == nil {
+				allowed[string(pub.Marshal())] = true
+			}
+		}
+		cert, err := sshutil.LoadCertificate(expanded)
+		if err == nil {
+			certs = append(certs, cert)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "Ignoring certificate for %s: %v\n", candidate, err)
+		}
+
+		signer, err := loadSigner(expanded)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", candidate, err)
+			continue
+		}
+		signers = append(signers, signer)
+		allowed[string(signer.PublicKey().Marshal())] = true
+	}
+	for _, cert := range certs {
+		allowed[string(cert.Key.Marshal())] = true
+	}
+
+	for _, signer := range sshutil.CertSigners(signers, certs) {
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	if agentClient, agentCleanup, err := sshutil.DialSSHAgent(); err == nil {
+		auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			agentSigners, err := agentClient.Signers()
+			if err != nil {
+				return nil, err
+			}
+			if identitiesOnly {
+				agentSigners = filterSigners(agentSigners, allowed)
+			}
+			return sshutil.CertSigners(agentSigners, certs), nil
+		}))
+		cleanup = agentCleanup
+	}
+
+	return auth, cleanup
+}
+
+// filterSigners keeps signers whose underlying key is in allowed.
+func filterSigners(signers []ssh.Signer, allowed map[string]bool) []ssh.Signer {
+	var kept []ssh.Signer
+	for _, signer := range signers {
+		pub := signer.PublicKey()
+		// Agent keys are opaque; re-parse to see through certificates.
+		if parsed, err := ssh.ParsePublicKey(pub.Marshal()); err == nil {
+			if cert, ok := parsed.(*ssh.Certificate); ok {
+				pub = cert.Key
+			}
+		}
+		if allowed[string(pub.Marshal())] {
+			kept = append(kept, signer)
+		}
+	}
+	return kept
+}
+
+func defaultIdentityCandidates() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	paths := []string{"id_ed25519", "id_rsa", "id_ecdsa"}
+	var expanded []string
+	for _, name := range paths {
+		expanded = append(expanded, filepath.Join(home, ".ssh", name))
+	}
+	return expanded
+}
+
+func loadSigner(path string) (ssh.Signer, error) {
+	expanded, err := expandPath(path)
+	if err != nil {
+		return nil, err
+	}
+	keyData, err := os.ReadFile(expanded)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if err == nil {
+		return signer, nil
+	}
+
+	var perr *ssh.PassphraseMissingError
+	if !errors.As(err, &perr) {
+		return nil, err
+	}
+
+	const maxAttempts = 3
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		passphrase, promptErr := promptPassphrase(expanded)
+		if promptErr != nil {
+			return nil, promptErr
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(keyData, passphrase)
+		zeroBytes(passphrase)
+		if err == nil {
+			return signer, nil
+		}
+		fmt.Fprintf(os.Stderr, "Incorrect passphrase (attempt %d/%d)\n", attempt, maxAttempts)
+	}
+
+	return nil, fmt.Errorf("failed to decrypt %s: %w", expanded, err)
+}
+
+func promptPassphrase(identityPath string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("passphrase required for %s but stdin is not a terminal; run ssh-add or specify --identity", identityPath)
+	}
+
+	fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", identityPath)
+	pass, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	return pass, nil
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func promptPassword(user, node string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("password required for %s@%s but stdin is not a terminal", user, node)
+	}
+
+	fmt.Fprintf(os.Stderr, "%s@%s's password: ", user, node)
+	pass, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(pass), nil
+}
+
+// errUnverifiedHost explains why method was not offered to node.
+func errUnverifiedHost(node, method string) error {
+	return fmt.Errorf("refusing %s authentication: the host key of %s is not verified; add it to known_hosts or configure cert-authorities", method, node)
+}
+
+// confirm asks a yes/no question on the terminal.
+func confirm(reader *bufio.Reader, question string) (bool, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false, errors.New("cannot confirm the host key: stdin is not a terminal")
+	}
+	for {
+		fmt.Fprint(os.Stderr, question)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "yes":
+			return true, nil
+		case "no":
+			return false, nil
+		}
+		question = "Please type 'yes' or 'no': "
+	}
+}
+
+func keyboardInteractiveChallenge(reader *bufio.Reader, name, instruction string, questions []string, echos []bool) ([]string, error) {
+	if len(questions) == 0 {
+		return nil, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("keyboard-interactive authentication requires a terminal")
+	}
+
+	if name != "" {
+		fmt.Fprintln(os.Stderr, name)
+	}
+	if instruction != "" {
+		fmt.Fprintln(os.Stderr, instruction)
+	}
+
+	answers := make([]string, len(questions))
+	for i, question := range questions {
+		fmt.Fprint(os.Stderr, question)
+		if echos[i] {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = strings.TrimRight(line, "\r\n")
+			continue
+		}
+		answer, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		answers[i] = string(answer)
+	}
+	return answers, nil
+}
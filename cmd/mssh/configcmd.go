@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	agentpkg "github.com/eznix86/mssh/internal/agent"
+	"github.com/eznix86/mssh/internal/config"
+	"github.com/eznix86/mssh/internal/proxy"
+	"github.com/eznix86/mssh/internal/sshconfig"
+	"github.com/eznix86/mssh/internal/sshutil"
+	"github.com/eznix86/mssh/internal/transport"
+)
+
+// loadConfigStrict reads the user config for commands that write it back, so
+// a malformed file is reported instead of being silently replaced and system
+// defaults are not copied into it.
+func loadConfigStrict() (config.Config, error) {
+	cfg, err := config.LoadUser()
+	if errors.Is(err, config.ErrNotFound) {
+		return config.Config{}, nil
+	}
+	return cfg, err
+}
+
+func runConfigSet(key, value string) error {
+	cfg, err := loadConfigStrict()
+	if err != nil {
+		return err
+	}
+	k, err := config.ParseKey(key)
+	if err != nil {
+		return err
+	}
+	if err := validateSetting(k.Field, value); err != nil {
+		return fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	if k.Field == "profile" && k.Node == "" && k.Profile == "" && value != "" {
+		if _, ok := cfg.Profiles[value]; !ok {
+			return fmt.Errorf("%w: %s", config.ErrUnknownProfile, value)
+		}
+	}
+	if err := cfg.Set(key, value); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return config.Save(cfg)
+}
+
+// runConfigGet prints the value of key. It reports false when the key is unset.
+func runConfigGet(key string) (bool, error) {
+	cfg, err := loadConfigStrict()
+	if err != nil {
+		return false, err
+	}
+	value, err := cfg.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if value == "" {
+		return false, nil
+	}
+	fmt.Println(value)
+	return true, nil
+}
+
+// runConfigUse makes profile the default for every command.
+func runConfigUse(profile string) error {
+	if err := runConfigSet("profile", profile); err != nil {
+		return err
+	}
+	fmt.Printf("Switched to profile %s\n", profile)
+	return nil
+}
+
+func runConfigUnset(key string) error {
+	cfg, err := loadConfigStrict()
+	if err != nil {
+		return err
+	}
+	if err := cfg.Unset(key); err != nil {
+		return err
+	}
+	// Removing the last value of a profile removes the profile as well.
+	if _, ok := cfg.Profiles[cfg.Profile]; cfg.Profile != "" && !ok {
+		return fmt.Errorf("profile %s is the default; switch with 'mssh config use' or run 'mssh config unset profile' first", cfg.Profile)
+	}
+	return config.Save(cfg)
+}
+
+func runConfigList() error {
+	cfg, err := loadConfigStrict()
+	if err != nil {
+		return err
+	}
+	for _, setting := range cfg.Settings() {
+		value := setting.Value
+		if setting.Secret {
+			// Tokens are only printed by 'mssh config get <key>'.
+			value = secretMask
+		}
+		fmt.Printf("%s=%s\n", setting.Key, value)
+	}
+	return nil
+}
+
+// validateSetting checks a value before it is written; empty values clear the key.
+func validateSetting(field, value string) error {
+	if value == "" {
+		return nil
+	}
+	switch field {
+	case "server", "agent.server":
+		return validateServerAddr(value)
+	case "agent.ssh-port":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port %q", value)
+		}
+	case "identity", "tls-ca", "tls-cert", "tls-key":
+		path, err := expandPath(value)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", path)
+		}
+	case "tls", "tls-insecure":
+		_, err := strconv.ParseBool(value)
+		return err
+	case "auth":
+		_, err := parseAuthOrder(config.SplitList(value))
+		return err
+	case "alias", "service", "profile", "agent.node-id", "agent.service":
+		if !nodeIDPattern.MatchString(value) {
+			return fmt.Errorf("%q may only contain letters, digits, '.', '_' and '-'", value)
+		}
+	case "agent.allow":
+		return agentpkg.ValidateAllow(config.SplitList(value))
+	case "agent.tags":
+		_, err := agentpkg.ParseTags(config.SplitList(value))
+		return err
+	case "cert-authorities":
+		_, err := sshutil.LoadCertAuthorities(config.SplitList(value), nil, "")
+		return err
+	}
+	return nil
+}
+
+// secretMask replaces secret values in 'mssh config list'.
+const secretMask = "********"
+
+var nodeIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+func validateServerAddr(addr string) error {
+	_, addr, err := transport.SplitWebSocket(addr)
+	if err != nil {
+		return err
+	}
+	addr, _ = transport.SplitScheme(addr)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host in %q", addr)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
+	return nil
+}
+
+// sshConfigOptions controls 'mssh config ssh-config'.
+type sshConfigOptions struct {
+	Output  string
+	Stdout  bool
+	Live    bool
+	Server  string
+	Command string
+}
+
+func runConfigSSHConfig(cfg config.Config, opts sshConfigOptions) error {
+	hosts := collectSSHConfigHosts(cfg, opts)
+	if len(hosts) == 0 && len(cfg.NodePatterns()) == 0 {
+		return fmt.Errorf("no nodes found; add nodes to the config or start agents")
+	}
+	block := renderSSHConfigBlock(cfg, hosts, opts)
+
+	if opts.Stdout {
+		fmt.Print(sshconfig.BeginMarker + "\n" + block + sshconfig.EndMarker + "\n")
+		return nil
+	}
+
+	path := sshconfig.ExpandHome(opts.Output)
+	changed, err := sshconfig.WriteManagedBlock(path, block)
+	if err != nil {
+		return err
+	}
+	if changed {
+		fmt.Printf("Updated %d host(s) in %s\n", len(hosts), path)
+	} else {
+		fmt.Printf("%s is already up to date\n", path)
+	}
+	return nil
+}
+
+// collectSSHConfigHosts maps every known node-id to the rendezvous server it
+// is reached through: explicit node entries first, then nodes reported live
+// by each configured server.
+func collectSSHConfigHosts(cfg config.Config, opts sshConfigOptions) map[string]string {
+	hosts := map[string]string{}
+	for nodeID := range cfg.Nodes {
+		if config.IsPattern(nodeID) {
+			continue
+		}
+		if server, err := resolveServer(opts.Server, cfg, nodeID); err == nil {
+			hosts[nodeID] = server
+		}
+	}
+	if !opts.Live {
+		return hosts
+	}
+
+	for _, server := range configuredServers(cfg, opts.Server) {
+		addr, err := rendezvousOptions(server, cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", server, err)
+			continue
+		}
+		nodes, err := proxy.ListNodes(addr, nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping live nodes from %s: %v\n", server, err)
+			continue
+		}
+		for _, node := range nodes {
+			nodeID := node.ID
+			if _, exists := hosts[nodeID]; exists {
+				continue
+			}
+			// node-id/service registrations are reached via --service.
+			if strings.Contains(nodeID, "/") {
+				continue
+			}
+			// A node reported by one server but pinned to another in the
+			// config is still reached through the configured server.
+			if pinned, err := resolveServer(opts.Server, cfg, nodeID); err == nil && pinned != server {
+				continue
+			}
+			hosts[nodeID] = server
+		}
+	}
+	return hosts
+}
+
+// configuredServers lists the distinct rendezvous servers named in the config,
+// or only flagValue when it is set.
+func configuredServers(cfg config.Config, flagValue string) []string {
+	if flagValue != "" {
+		return []string{flagValue}
+	}
+	seen := map[string]bool{}
+	var servers []string
+	add := func(server string) {
+		if server != "" && !seen[server] {
+			seen[server] = true
+			servers = append(servers, server)
+		}
+	}
+	add(cfg.Server)
+	for _, entry := range cfg.Nodes {
+		add(entry.Server)
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// renderSSHConfigBlock writes one stanza per node followed by one per node
+// pattern, so OpenSSH's first-match rule mirrors mssh's most-specific-wins.
+func renderSSHConfigBlock(cfg config.Config, hosts map[string]string, opts sshConfigOptions) string {
+	nodes := make([]string, 0, len(hosts))
+	for nodeID := range hosts {
+		nodes = append(nodes, nodeID)
+	}
+	sort.Strings(nodes)
+
+	// Pin the active profile so later 'mssh config use' calls do not change
+	// which servers existing entries go through.
+	command := proxyCommandQuote(opts.Command)
+	if cfg.Profile != "" {
+		command += " --profile " + proxyCommandQuote(cfg.Profile)
+	}
+
+	var b strings.Builder
+	for _, nodeID := range nodes {
+		if alias := cfg.Nodes[nodeID].Alias; alias != "" {
+			fmt.Fprintf(&b, "Host %s %s\n", nodeID, alias)
+		} else {
+			fmt.Fprintf(&b, "Host %s\n", nodeID)
+		}
+		if user := cfg.UserFor(nodeID); user != "" {
+			fmt.Fprintf(&b, "    User %s\n", user)
+		}
+		if identity := cfg.IdentityFor(nodeID); identity != "" {
+			fmt.Fprintf(&b, "    IdentityFile %s\n", sshConfigQuote(identity))
+		}
+		fmt.Fprintf(&b, "    ProxyCommand %s proxy %s --server %s\n", command, proxyCommandQuote(nodeID), proxyCommandQuote(hosts[nodeID]))
+	}
+
+	for _, pattern := range cfg.NodePatterns() {
+		// A bare "*" would capture every host in ~/.ssh/config, not just nodes.
+		if strings.Trim(pattern, "*") == "" {
+			continue
+		}
+		// Resolving the pattern itself as a node-id inherits settings from
+		// broader patterns, e.g. prod-db-* picks up the server set on prod-*.
+		server, err := resolveServer(opts.Server, cfg, pattern)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&b, "Host %s\n", pattern)
+		if user := cfg.UserFor(pattern); user != "" {
+			fmt.Fprintf(&b, "    User %s\n", user)
+		}
+		if identity := cfg.IdentityFor(pattern); identity != "" {
+			fmt.Fprintf(&b, "    IdentityFile %s\n", sshConfigQuote(identity))
+		}
+		fmt.Fprintf(&b, "    ProxyCommand %s proxy %%h --server %s\n", command, proxyCommandQuote(server))
+	}
+	return b.String()
+}
+
+// sshConfigQuote escapes ssh_config tokens in an IdentityFile path and
+// double-quotes it when it contains spaces.
+func sshConfigQuote(value string) string {
+	value = strings.ReplaceAll(value, "%", "%%")
+	if strings.ContainsAny(value, " \t") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// proxyCommandQuote quotes one ProxyCommand argument for the shell ssh runs
+// it with, and escapes ssh_config tokens.
+func proxyCommandQuote(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.,:/@+=%~") == "" && !strings.HasPrefix(arg, "~") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
@@ -5,24 +5,32 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/term"
 
 	agentpkg "github.com/eznix86/mssh/internal/agent"
+	"github.com/eznix86/mssh/internal/audit"
 	"github.com/eznix86/mssh/internal/config"
+	"github.com/eznix86/mssh/internal/logging"
+	"github.com/eznix86/mssh/internal/protocol"
 	"github.com/eznix86/mssh/internal/proxy"
 	"github.com/eznix86/mssh/internal/server"
+	"github.com/eznix86/mssh/internal/sshconfig"
 	"github.com/eznix86/mssh/internal/sshutil"
+	"github.com/eznix86/mssh/internal/transport"
 )
 
 var (
@@ -33,78 +41,230 @@ var (
 
 const (
 	defaultServerAddr = "localhost:8443"
+	defaultSSHPort    = 22
 )
 
 func main() {
 	app := kingpin.New("mssh", "Minimal SSH rendezvous system").Version(version)
+	profileName := app.Flag("profile", "Config profile to use (overrides the default set with 'mssh config use')").Envar("MSSH_PROFILE").String()
+	logFormat := app.Flag("log-format", "Log format: text or json").Envar("MSSH_LOG_FORMAT").Default(logging.FormatText).Enum(logging.FormatText, logging.FormatJSON)
+	logLevel := app.Flag("log-level", "Minimum log level: debug, info, warn or error").Envar("MSSH_LOG_LEVEL").Default("info").Enum("debug", "info", "warn", "error")
 
 	serverCmd := app.Command("server", "Run the rendezvous server")
-	serverHost := serverCmd.Flag("host", "Bind address").Default("0.0.0.0").String()
-	serverPort := serverCmd.Flag("port", "Listen port").Default("8443").Int()
+	serverHost := serverCmd.Flag("host", "Bind address (default 0.0.0.0)").String()
+	serverPort := serverCmd.Flag("port", "Listen port (default 8443)").Int()
+	serverConfig := serverCmd.Flag("config", "Server config file (listeners, TLS, tokens, limits, logging); reloaded on SIGHUP").String()
+
+	verifyAuditCmd := app.Command("verify-audit", "Check the hash chain of audit log files")
+	verifyAuditConfig := verifyAuditCmd.Flag("config", "Server config file holding audit.hash-key").Required().String()
+	verifyAuditFiles := verifyAuditCmd.Arg("files", "Audit files, oldest first (defaults to audit.file and its rotations)").Strings()
 
 	agentCmd := app.Command("agent", "Run an agent behind NAT")
 	agentNodeID := agentCmd.Arg("node-id", "Unique node identifier (defaults to primary host IP)").Default("").String()
 	agentServer := agentCmd.Flag("server", "Rendezvous server host:port").String()
-	agentSSHPort := agentCmd.Flag("ssh-port", "Local SSH port to tunnel to").Default("22").Int()
+	agentSSHPort := agentCmd.Flag("ssh-port", "Local SSH port to tunnel to (default 22)").Int()
+	agentService := agentCmd.Flag("service", "Register --ssh-port as a named service of the node instead of its default").String()
+	agentAllow := agentCmd.Flag("allow", "Only pair with this client: token:<name>, subject:<cert CN> or fingerprint:SHA256:<...> (repeatable)").Strings()
+	agentTags := agentCmd.Flag("tag", "Report a key=value tag to the server for 'mssh nodes --tag' (repeatable)").Strings()
+	agentConfig := agentCmd.Flag("config", "Agent config file with one or more registrations; reloaded on SIGHUP").String()
 
 	proxyCmd := app.Command("proxy", "ProxyCommand helper that connects via rendezvous server")
-	proxyNodeID := proxyCmd.Arg("node-id", "Node identifier to connect to").Required().String()
+	proxyNodeID := proxyCmd.Arg("node-id", "Node identifier or configured alias to connect to").Required().String()
 	proxyServer := proxyCmd.Flag("server", "Rendezvous server host:port").String()
+	proxyService := proxyCmd.Flag("service", "Agent service to reach (defaults to the node's SSH service)").String()
+	proxyWait := proxyCmd.Flag("wait", waitHelp).Duration()
+	proxyDirect := proxyCmd.Flag("direct", directHelp).Bool()
 
 	sshCmd := app.Command("ssh", "Connect to a node via rendezvous and open an interactive SSH session")
-	sshTarget := sshCmd.Arg("target", "Target in the form user@node-id").Required().String()
-	sshServer := sshCmd.Flag("server", "Rendezvous server host:port").String()
-	sshIdentity := sshCmd.Flag("identity", "Path to private key used for authentication").String()
+	sshTarget := sshCmd.Arg("target", "Target in the form [user@]node-id or a configured alias").Required().String()
+	sshCommand := sshCmd.Arg("command", "Remote command to run instead of a shell").Strings()
+	sshFlags := registerClientFlags(sshCmd)
+	sshForwardAgent := sshCmd.Flag("forward-agent", "Forward the local SSH agent (SSH_AUTH_SOCK) to the remote host").Short('A').Bool()
+	sshTTY := sshCmd.Flag("tty", "Force pseudo-terminal allocation for a remote command").Short('t').Bool()
+
+	sftpCmd := app.Command("sftp", "Open an interactive SFTP session to a node via rendezvous")
+	sftpTarget := sftpCmd.Arg("target", "Target in the form [user@]node-id or a configured alias").Required().String()
+	sftpFlags := registerClientFlags(sftpCmd)
 
 	configCmd := app.Command("config", "Manage mssh configuration")
 	configInitCmd := configCmd.Command("init", "Interactively create or update ~/.mssh/config.yaml")
-
+	configSetCmd := configCmd.Command("set", "Set a config value (e.g. server, nodes.<node-id>.identity)")
+	configSetKey := configSetCmd.Arg("key", "Config key").Required().String()
+	configSetValue := configSetCmd.Arg("value", "Value; lists are comma-separated").Required().String()
+	configGetCmd := configCmd.Command("get", "Print a config value; exits 1 when unset")
+	configGetKey := configGetCmd.Arg("key", "Config key").Required().String()
+	configUnsetCmd := configCmd.Command("unset", "Remove a config value, or all overrides with nodes.<node-id>")
+	configUnsetKey := configUnsetCmd.Arg("key", "Config key").Required().String()
+	configListCmd := configCmd.Command("list", "Print all config values as key=value")
+	configUseCmd := configCmd.Command("use", "Set the default profile")
+	configUseProfile := configUseCmd.Arg("profile", "Profile name from the profiles section").Required().String()
+	configSSHCmd := configCmd.Command("ssh-config", "Write Host entries for known nodes into ~/.ssh/config")
+	configSSHOutput := configSSHCmd.Flag("output", "OpenSSH config file holding the managed block").Short('o').Default("~/.ssh/config").String()
+	configSSHStdout := configSSHCmd.Flag("stdout", "Print the managed block instead of writing it").Bool()
+	configSSHLive := configSSHCmd.Flag("live", "Include nodes currently registered on the rendezvous servers").Default("true").Bool()
+	configSSHServer := configSSHCmd.Flag("server", "Rendezvous server host:port (overrides the config)").String()
+	configSSHCommand := configSSHCmd.Flag("command", "mssh command used in ProxyCommand").Default("mssh").String()
+
+	nodesCmd := app.Command("nodes", "List nodes currently registered on the rendezvous server")
+	nodesServer := nodesCmd.Flag("server", "Rendezvous server host:port").String()
+	nodesTags := nodesCmd.Flag("tag", "Only list nodes with this key=value tag (repeatable)").Strings()
+	nodesLong := nodesCmd.Flag("long", "Show hostname, platform, agent version, uptime, addresses and tags").Short('l').Bool()
+
+	// The config is needed to parse the arguments; a problem with it is only
+	// reported once logging is set up.
+	cfg, cfgErr := loadConfig()
 	args := os.Args[1:]
-	if needsImplicitSSH(args) {
+	if needsImplicitSSH(args, cfg) {
 		args = append([]string{"ssh"}, args...)
 	}
+	args = endSSHFlags(args, app.Model().FlagGroupModel, sshCmd.Model().FlagGroupModel)
+
+	command := kingpin.MustParse(app.Parse(args))
+	if err := logging.Setup(*logFormat, *logLevel); err != nil {
+		app.Fatalf("%v", err)
+	}
+	// Commands that edit the config work on the file as written and report
+	// its errors themselves; everything else sees the active profile merged in.
+	if !strings.HasPrefix(command, configCmd.FullCommand()+" ") || command == configSSHCmd.FullCommand() {
+		if cfgErr != nil {
+			slog.Warn("continuing with default config", logging.KeyComponent, "config", logging.Err(cfgErr))
+		}
+		var err error
+		if cfg, err = cfg.WithProfile(*profileName); err != nil {
+			fatal("config", err)
+		}
+	}
 
-	switch kingpin.MustParse(app.Parse(args)) {
+	switch command {
 	case serverCmd.FullCommand():
-		runServer(*serverHost, *serverPort)
+		runServer(*serverHost, *serverPort, *serverConfig)
+	case verifyAuditCmd.FullCommand():
+		if err := runVerifyAudit(*verifyAuditConfig, *verifyAuditFiles); err != nil {
+			fatal("audit", err)
+		}
 	case agentCmd.FullCommand():
-		serverAddr := *agentServer
-		if serverAddr == "" {
-			serverAddr = defaultServerAddr
+		if *agentConfig != "" {
+			if *agentNodeID != "" || *agentServer != "" || *agentSSHPort != 0 || *agentService != "" || len(*agentAllow) > 0 || len(*agentTags) > 0 {
+				fatal("agent", errors.New("node-id, --server, --ssh-port, --service, --allow and --tag cannot be combined with --config"))
+			}
+			runAgentConfig(*agentConfig, cfg)
+			return
+		}
+		serverAddr := firstNonEmpty(*agentServer, os.Getenv("MSSH_SERVER"), cfg.Agent.Server, cfg.Server, defaultServerAddr)
+		nodeID := firstNonEmpty(*agentNodeID, cfg.Agent.NodeID)
+		sshPort := firstNonZero(*agentSSHPort, cfg.Agent.SSHPort, defaultSSHPort)
+		service := firstNonEmpty(*agentService, cfg.Agent.Service)
+		allow := *agentAllow
+		if len(allow) == 0 {
+			allow = cfg.Agent.Allow
+		}
+		tags, err := agentpkg.ParseTags(*agentTags)
+		if err != nil {
+			fatal("agent", err)
 		}
-		runAgent(*agentNodeID, serverAddr, *agentSSHPort)
+		runAgent(nodeID, serverAddr, sshPort, service, allow, mergeTags(cfg.Agent.Tags, tags), cfg)
 	case proxyCmd.FullCommand():
-		serverAddr := *proxyServer
-		if serverAddr == "" {
-			log.Fatalf("[proxy] --server is required")
+		nodeID := *proxyNodeID
+		if resolved, ok := cfg.ResolveAlias(nodeID); ok {
+			nodeID = resolved
+		}
+		serverAddr, err := resolveServer(*proxyServer, cfg, nodeID)
+		if err != nil {
+			fatal("proxy", err)
+		}
+		service := *proxyService
+		if service == "" {
+			service = cfg.ServiceFor(nodeID)
 		}
-		runProxy(*proxyNodeID, serverAddr)
+		runProxy(nodeID, service, serverAddr, *proxyWait, *proxyDirect, cfg)
 
 	case sshCmd.FullCommand():
-		cfg := loadConfig()
-		user, node, err := parseTarget(*sshTarget)
+		opts, err := resolveClientOptions(cfg, *sshTarget, sshFlags)
 		if err != nil {
-			log.Fatalf("[ssh] %v", err)
+			fatal("ssh", err)
 		}
-		serverAddr, err := resolveServer(*sshServer, cfg, node)
+		opts.ForwardAgent = *sshForwardAgent
+		// A node's default command stands in for the shell, so it gets a
+		// terminal like one; commands given here only do with -t.
+		opts.TTY = *sshTTY || opts.Command != ""
+		if len(*sshCommand) > 0 {
+			opts.Command = strings.Join(*sshCommand, " ")
+			opts.TTY = *sshTTY
+		}
+		if err := runSSH(opts); err != nil {
+			fatal("ssh", err)
+		}
+	case sftpCmd.FullCommand():
+		opts, err := resolveClientOptions(cfg, *sftpTarget, sftpFlags)
 		if err != nil {
-			log.Fatalf("[ssh] %v", err)
+			fatal("sftp", err)
 		}
-		identity := resolveIdentity(*sshIdentity, cfg, node)
-		if err := runSSH(user, node, serverAddr, identity); err != nil {
-			log.Fatalf("[ssh] %v", err)
+		if err := runSFTP(opts); err != nil {
+			fatal("sftp", err)
 		}
 	case configInitCmd.FullCommand():
-		cfg := loadConfig()
-		if err := runConfigInit(cfg); err != nil {
-			log.Fatalf("[config] %v", err)
+		existing, err := loadConfigStrict()
+		if err != nil {
+			fatal("config", err)
+		}
+		if err := runConfigInit(existing); err != nil {
+			fatal("config", err)
 		}
 		return
+	case configSetCmd.FullCommand():
+		if err := runConfigSet(*configSetKey, *configSetValue); err != nil {
+			fatal("config", err)
+		}
+	case configGetCmd.FullCommand():
+		found, err := runConfigGet(*configGetKey)
+		if err != nil {
+			fatal("config", err)
+		}
+		if !found {
+			os.Exit(1)
+		}
+	case configUnsetCmd.FullCommand():
+		if err := runConfigUnset(*configUnsetKey); err != nil {
+			fatal("config", err)
+		}
+	case configListCmd.FullCommand():
+		if err := runConfigList(); err != nil {
+			fatal("config", err)
+		}
+	case configUseCmd.FullCommand():
+		if err := runConfigUse(*configUseProfile); err != nil {
+			fatal("config", err)
+		}
+	case configSSHCmd.FullCommand():
+		opts := sshConfigOptions{
+			Output:  *configSSHOutput,
+			Stdout:  *configSSHStdout,
+			Live:    *configSSHLive,
+			Server:  *configSSHServer,
+			Command: *configSSHCommand,
+		}
+		if err := runConfigSSHConfig(cfg, opts); err != nil {
+			fatal("config", err)
+		}
+	case nodesCmd.FullCommand():
+		serverAddr, err := resolveServer(*nodesServer, cfg, "")
+		if err != nil {
+			fatal("nodes", err)
+		}
+		tags, err := agentpkg.ParseTags(*nodesTags)
+		if err != nil {
+			fatal("nodes", err)
+		}
+		if err := runNodes(serverAddr, cfg, tags, *nodesLong); err != nil {
+			fatal("nodes", err)
+		}
 	}
 
 }
 
-func needsImplicitSSH(args []string) bool {
+// needsImplicitSSH reports whether args start with a connection target
+// (user@node or a node-id/alias from the config) rather than a subcommand.
+func needsImplicitSSH(args []string, cfg config.Config) bool {
 	if len(args) == 0 {
 		return false
 	}
@@ -113,62 +273,173 @@ func needsImplicitSSH(args []string) bool {
 		return false
 	}
 	switch first {
-	case "server", "agent", "proxy", "ssh", "help", "--help", "-h", "version", "--version", "-v":
+	case "server", "verify-audit", "agent", "proxy", "ssh", "sftp", "config", "nodes", "help", "--help", "-h", "version", "--version", "-v":
+		return false
+	}
+	return strings.Contains(first, "@") || cfg.KnowsNode(first)
+}
+
+// endSSHFlags inserts "--" before the remote command of the ssh command, so
+// its options (mssh ssh db ls -la) are not taken as mssh flags. As with
+// OpenSSH, flags between the target and the command still apply. groups hold
+// the flags that may appear in args.
+func endSSHFlags(args []string, groups ...*kingpin.FlagGroupModel) []string {
+	takesValue := func(match func(*kingpin.FlagModel) bool) bool {
+		for _, group := range groups {
+			for _, flag := range group.Flags {
+				if match(flag) {
+					return !flag.IsBoolFlag()
+				}
+			}
+		}
 		return false
 	}
-	return strings.Contains(first, "@")
+
+	seenSSH, seenTarget := false, false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return args
+		case strings.HasPrefix(arg, "--"):
+			name, _, hasValue := strings.Cut(arg[2:], "=")
+			if !hasValue && takesValue(func(f *kingpin.FlagModel) bool { return f.Name == name }) {
+				i++
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			for j, short := range arg[1:] {
+				if takesValue(func(f *kingpin.FlagModel) bool { return f.Short == short }) {
+					if j+2 == len(arg) {
+						i++
+					}
+					break
+				}
+			}
+		case !seenSSH:
+			if arg != "ssh" {
+				return args
+			}
+			seenSSH = true
+		case !seenTarget:
+			seenTarget = true
+		default:
+			out := append(append([]string{}, args[:i]...), "--")
+			return append(out, args[i:]...)
+		}
+	}
+	return args
 }
 
-func runServer(host string, port int) {
+// runVerifyAudit checks the audit hash chain with the key from the server
+// config. Without files it checks audit.file and its rotations, oldest first.
+func runVerifyAudit(configPath string, files []string) error {
+	cfg, err := server.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if cfg.Audit.HashKey == "" {
+		return fmt.Errorf("%s: audit.hash-key is not set", configPath)
+	}
+	if len(files) == 0 {
+		if cfg.Audit.File == "" {
+			return fmt.Errorf("%s: audit.file is not set; name the files to check", configPath)
+		}
+		for i := max(cfg.Audit.MaxFiles, 1); i >= 1; i-- {
+			rotated := fmt.Sprintf("%s.%d", cfg.Audit.File, i)
+			if _, err := os.Stat(rotated); err == nil {
+				files = append(files, rotated)
+			}
+		}
+		files = append(files, cfg.Audit.File)
+	}
+	records, err := audit.VerifyFiles([]byte(cfg.Audit.HashKey), files...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d records verified\n", records)
+	return nil
+}
+
+func runServer(host string, port int, configPath string) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	srv, err := server.New(server.Options{Host: host, Port: port, ConfigPath: configPath})
+	if err != nil {
+		fatal("server", err)
+	}
+	logger := logging.Component("server")
+
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
-		<-sigCh
-		log.Println("[server] received interrupt, shutting down...")
-		cancel()
+		for sig := range sigCh {
+			if sig == syscall.SIGHUP {
+				if err := srv.Reload(); err != nil {
+					logger.Error("reload failed", logging.Err(err))
+				} else {
+					logger.Info("configuration reloaded")
+				}
+				continue
+			}
+			logger.Info("shutting down", "signal", sig.String())
+			cancel()
+			return
+		}
 	}()
 
-	srv := server.New(server.Options{Host: host, Port: port})
 	if err := srv.Run(ctx); err != nil {
-		log.Fatalf("[server] %v", err)
+		fatal("server", err)
 	}
 }
 
-func runAgent(nodeID, serverAddr string, sshPort int) {
+func runAgent(nodeID, serverAddr string, sshPort int, service string, allow []string, tags map[string]string, cfg config.Config) {
 	if nodeID == "" {
 		nodeID = defaultNodeID()
 		if nodeID == "" {
-			log.Fatalf("[agent] unable to determine default node-id; specify one explicitly")
+			fatal("agent", errors.New("unable to determine default node-id; specify one explicitly"))
 		}
-		log.Printf("[agent] auto-detected node-id %s", nodeID)
+		logging.Component("agent").Info("auto-detected node-id", logging.KeyNodeID, nodeID)
 	} else {
 		nodeID = sanitizeNodeID(nodeID)
 		if nodeID == "" {
-			log.Fatalf("[agent] provided node-id is empty after sanitization")
+			fatal("agent", errors.New("provided node-id is empty after sanitization"))
 		}
 	}
 
+	if err := agentpkg.ValidateAllow(allow); err != nil {
+		fatal("agent", err)
+	}
+	if err := validateTags(tags); err != nil {
+		fatal("agent", err)
+	}
 	agentOpts, err := agentpkg.ParseServerAddr(serverAddr)
 	if err != nil {
-		log.Fatalf("[agent] invalid server address: %v", err)
+		fatal("agent", fmt.Errorf("invalid server address: %w", err))
 	}
 	agentOpts.NodeID = nodeID
 	agentOpts.SSHPort = sshPort
+	agentOpts.Service = service
+	agentOpts.Token = cfg.Token
+	agentOpts.TLS = transportTLS(cfg.TLS)
+	agentOpts.Allow = allow
+	agentOpts.Tags = tags
+	agentOpts.Version = version
 
 	if err := agentpkg.Run(agentOpts); err != nil {
-		log.Fatalf("[agent] %v", err)
+		fatal("agent", err)
 	}
 }
 
-func runProxy(nodeID, serverAddr string) {
-	addr, err := proxy.ParseServerAddr(serverAddr)
+func runProxy(nodeID, service, serverAddr string, wait time.Duration, direct bool, cfg config.Config) {
+	addr, err := rendezvousOptions(serverAddr, cfg)
 	if err != nil {
-		log.Fatalf("[proxy] invalid server address: %v", err)
+		fatal("proxy", fmt.Errorf("invalid server address: %w", err))
 	}
 	addr.NodeID = nodeID
+	addr.Service = service
+	addr.Wait = wait
+	addr.Direct = direct
 
 	if err := proxy.Run(addr, os.Stdin, os.Stdout); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -176,42 +447,216 @@ func runProxy(nodeID, serverAddr string) {
 	}
 }
 
-func runSSH(user, node, serverAddr, identity string) error {
-	serverOpts, err := proxy.ParseServerAddr(serverAddr)
+// clientOptions holds the resolved settings for the built-in SSH and SFTP clients.
+type clientOptions struct {
+	User           string
+	Node           string
+	Service        string
+	Command        string
+	Server         string
+	Token          string
+	TLS            transport.TLSOptions
+	Identities     []string
+	IdentitiesOnly bool
+	Auth           []string
+	ForwardAgent   bool
+	// TTY requests a terminal for Command, as ssh -t does.
+	TTY bool
+	// Host CA keys (or files holding them); when any apply to the node, the
+	// host must present a certificate signed by one of them.
+	CertAuthorities []string
+	// Otherwise the host key is looked up in known_hosts files.
+	UserKnownHostsFiles   []string
+	GlobalKnownHostsFiles []string
+	StrictHostKeyChecking string
+
+	KeepAliveInterval time.Duration
+	KeepAliveCountMax int
+	LocalForwards     []string
+	Wait              time.Duration
+	Direct            bool
+}
+
+// clientFlags are the flags shared by the ssh and sftp commands.
+type clientFlags struct {
+	server    *string
+	identity  *string
+	auth      *string
+	sshConfig *string
+	wait      *time.Duration
+	direct    *bool
+}
+
+const (
+	waitHelp   = "Wait up to this long for the node's agent to come online (e.g. 30s)"
+	directHelp = "Try a direct peer-to-peer connection to the agent, falling back to the relay"
+)
+
+func registerClientFlags(cmd *kingpin.CmdClause) *clientFlags {
+	return &clientFlags{
+		server:    cmd.Flag("server", "Rendezvous server host:port").String(),
+		identity:  cmd.Flag("identity", "Path to private key used for authentication").String(),
+		auth:      cmd.Flag("auth", "Comma-separated authentication methods to try in order (publickey,keyboard-interactive,password)").String(),
+		sshConfig: cmd.Flag("ssh-config", "OpenSSH client config to read (\"none\" to ignore)").Short('F').Default("~/.ssh/config").String(),
+		wait:      cmd.Flag("wait", waitHelp).Duration(),
+		direct:    cmd.Flag("direct", directHelp).Bool(),
+	}
+}
+
+// resolveClientOptions merges CLI flags, ~/.mssh/config.yaml and ~/.ssh/config
+// for target, in that order of precedence. Aliases from the config are
+// replaced by their node-id; ~/.ssh/config is matched on the name as typed.
+func resolveClientOptions(cfg config.Config, target string, flags *clientFlags) (clientOptions, error) {
+	user, name, err := parseTarget(target)
 	if err != nil {
-		return fmt.Errorf("invalid server address: %w", err)
+		return clientOptions{}, err
+	}
+	node := name
+	if nodeID, ok := cfg.ResolveAlias(name); ok {
+		node = nodeID
+	}
+	openSSH, err := loadOpenSSHSettings(*flags.sshConfig, name)
+	if err != nil {
+		return clientOptions{}, fmt.Errorf("ssh config: %w", err)
+	}
+	if user == "" {
+		user = cfg.UserFor(node)
+	}
+	if user == "" {
+		user = openSSH.User
+	}
+	if user == "" {
+		return clientOptions{}, fmt.Errorf("missing user in %q; use user@node-id or set a user in the config", target)
 	}
-	serverOpts.NodeID = node
 
-	conn, err := proxy.Dial(serverOpts)
+	serverAddr, err := resolveServer(*flags.server, cfg, node)
 	if err != nil {
-		return err
+		return clientOptions{}, err
+	}
+	auth, err := resolveAuth(*flags.auth, cfg, node)
+	if err != nil {
+		return clientOptions{}, err
+	}
+
+	var identities []string
+	if identity := resolveIdentity(*flags.identity, cfg, node); identity != "" {
+		identities = []string{identity}
+	} else {
+		identities = openSSH.identityFiles(user, node)
 	}
 
-	auth, cleanupAgent, err := buildAuthMethods(identity)
+	return clientOptions{
+		User:                  user,
+		Node:                  node,
+		Service:               cfg.ServiceFor(node),
+		Command:               cfg.CommandFor(node),
+		Server:                serverAddr,
+		Token:                 cfg.Token,
+		TLS:                   transportTLS(cfg.TLS),
+		Identities:            identities,
+		IdentitiesOnly:        openSSH.IdentitiesOnly,
+		Auth:                  auth,
+		CertAuthorities:       cfg.CertAuthorities,
+		UserKnownHostsFiles:   openSSH.knownHostsFiles(user, node),
+		GlobalKnownHostsFiles: openSSH.GlobalKnownHostsFiles,
+		StrictHostKeyChecking: openSSH.StrictHostKeyChecking,
+		KeepAliveInterval:     openSSH.ServerAliveInterval,
+		KeepAliveCountMax:     openSSH.ServerAliveCountMax,
+		LocalForwards:         openSSH.LocalForwards,
+		Wait:                  *flags.wait,
+		Direct:                *flags.direct,
+	}, nil
+}
+
+func runNodes(serverAddr string, cfg config.Config, tags map[string]string, long bool) error {
+	addr, err := rendezvousOptions(serverAddr, cfg)
+	if err != nil {
+		return fmt.Errorf("invalid server address: %w", err)
+	}
+	nodes, err := proxy.ListNodes(addr, tags)
 	if err != nil {
 		return err
 	}
-	if cleanupAgent != nil {
-		defer cleanupAgent()
+	if !long {
+		for _, node := range nodes {
+			fmt.Println(node.ID)
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tHOSTNAME\tPLATFORM\tVERSION\tUPTIME\tIPS\tTAGS")
+	for _, node := range nodes {
+		platform := ""
+		if node.Meta[protocol.FieldOS] != "" {
+			platform = node.Meta[protocol.FieldOS] + "/" + node.Meta[protocol.FieldArch]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			node.ID,
+			orDash(node.Meta[protocol.FieldHostname]),
+			orDash(platform),
+			orDash(node.Meta[protocol.FieldVersion]),
+			orDash(formatUptime(node.Meta[protocol.FieldUptime])),
+			orDash(node.Meta[protocol.FieldIPs]),
+			orDash(node.Meta[protocol.FieldTags]))
 	}
+	return w.Flush()
+}
 
-	if len(auth) == 0 {
-		return fmt.Errorf("no SSH authentication methods available; provide --identity or configure SSH_AUTH_SOCK")
+// formatUptime renders seconds as e.g. "3d4h" or "12m".
+func formatUptime(seconds string) string {
+	n, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return ""
 	}
+	d := time.Duration(n) * time.Second
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd%dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", d/time.Hour, d%time.Hour/time.Minute)
+	default:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+}
 
-	config := &ssh.ClientConfig{
-		User:            user,
-		Auth:            auth,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// mergeTags returns base with override's keys replacing its own.
+func mergeTags(base, override map[string]string) map[string]string {
+	if len(base) == 0 {
+		return override
 	}
+	merged := make(map[string]string, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		merged[key] = value
+	}
+	return merged
+}
 
-	clientConn, chans, reqs, err := ssh.NewClientConn(conn, node, config)
+// validateTags checks tags read from config files.
+func validateTags(tags map[string]string) error {
+	for key, value := range tags {
+		if err := protocol.ValidateTag(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runSSH(opts clientOptions) error {
+	client, cleanup, err := dialSSH(opts)
 	if err != nil {
-		return fmt.Errorf("ssh handshake failed: %w", err)
+		return err
 	}
-	client := ssh.NewClient(clientConn, chans, reqs)
-	defer client.Close()
+	defer cleanup()
 
 	session, err := client.NewSession()
 	if err != nil {
@@ -219,14 +664,34 @@ func runSSH(user, node, serverAddr, identity string) error {
 	}
 	defer session.Close()
 
-	restore := prepareTerminal(session)
-	defer restore()
+	if opts.ForwardAgent {
+		if err := sshutil.ForwardAgent(client, session); err != nil {
+			fmt.Fprintf(os.Stderr, "Agent forwarding disabled: %v\n", err)
+		}
+	}
+
+	stopForwards, err := startLocalForwards(client, opts.LocalForwards)
+	if err != nil {
+		return err
+	}
+	defer stopForwards()
+
+	// As with OpenSSH, commands get plain pipes unless a terminal was asked
+	// for, so their input and output pass through unchanged.
+	if opts.Command == "" || opts.TTY {
+		restore := prepareTerminal(session)
+		defer restore()
+	}
 
 	session.Stdout = os.Stdout
 	session.Stderr = os.Stderr
 	session.Stdin = os.Stdin
 
-	if err := session.Shell(); err != nil {
+	if opts.Command != "" {
+		if err := session.Start(opts.Command); err != nil {
+			return fmt.Errorf("start command: %w", err)
+		}
+	} else if err := session.Shell(); err != nil {
 		return fmt.Errorf("start shell: %w", err)
 	}
 
@@ -241,10 +706,107 @@ func runSSH(user, node, serverAddr, identity string) error {
 	return nil
 }
 
+// dialSSH connects to node through the rendezvous server and completes the SSH
+// handshake. The returned cleanup closes the client and any agent connection.
+func dialSSH(opts clientOptions) (*ssh.Client, func(), error) {
+	serverOpts, err := proxy.ParseServerAddr(opts.Server)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid server address: %w", err)
+	}
+	serverOpts.NodeID = opts.Node
+	serverOpts.Service = opts.Service
+	serverOpts.Token = opts.Token
+	serverOpts.TLS = opts.TLS
+	serverOpts.Wait = opts.Wait
+	serverOpts.Direct = opts.Direct
+
+	conn, err := proxy.Dial(serverOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	knownHostsFiles := append(append([]string{}, opts.UserKnownHostsFiles...), opts.GlobalKnownHostsFiles...)
+	authorities, err := sshutil.LoadCertAuthorities(opts.CertAuthorities, knownHostsFiles, opts.Node)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// One reader serves every prompt of the session, so no typed-ahead input
+	// is lost between them.
+	prompt := bufio.NewReader(os.Stdin)
+	hostKeys := &sshutil.HostKeyChecker{
+		Authorities: authorities,
+		UserFiles:   opts.UserKnownHostsFiles,
+		GlobalFiles: opts.GlobalKnownHostsFiles,
+		Strict:      opts.StrictHostKeyChecking,
+		Confirm: func(question string) (bool, error) {
+			return confirm(prompt, question)
+		},
+	}
+	hostKeyCallback, hostKeyAlgorithms, err := hostKeys.Callback(opts.Node)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("known hosts: %w", err)
+	}
+
+	auth, cleanupAgent, err := buildAuthMethods(opts, prompt, hostKeys)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if len(auth) == 0 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("no SSH authentication methods available; provide --identity or configure SSH_AUTH_SOCK")
+	}
+
+	config := &ssh.ClientConfig{
+		User:              opts.User,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+	}
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, sshutil.HostKeyAddress(opts.Node), config)
+	if err != nil {
+		conn.Close()
+		if cleanupAgent != nil {
+			cleanupAgent()
+		}
+		return nil, nil, fmt.Errorf("ssh handshake failed: %w", err)
+	}
+	// A forwarded agent signs for whoever holds the session, so only hand it
+	// to a host whose key was verified.
+	if opts.ForwardAgent && !hostKeys.Verified() {
+		clientConn.Close()
+		if cleanupAgent != nil {
+			cleanupAgent()
+		}
+		return nil, nil, fmt.Errorf("refusing to forward the SSH agent: the host key of %s is not verified; add it to known_hosts or configure cert-authorities", opts.Node)
+	}
+	client := ssh.NewClient(clientConn, chans, reqs)
+	startKeepAlive(client, opts.KeepAliveInterval, opts.KeepAliveCountMax)
+
+	cleanup := func() {
+		client.Close()
+		if cleanupAgent != nil {
+			cleanupAgent()
+		}
+	}
+	return client, cleanup, nil
+}
+
+// parseTarget splits [user@]node-id; user is empty when omitted.
 func parseTarget(target string) (string, string, error) {
+	if !strings.Contains(target, "@") {
+		if target == "" {
+			return "", "", fmt.Errorf("missing node-id")
+		}
+		return "", target, nil
+	}
 	parts := strings.Split(target, "@")
 	if len(parts) != 2 {
-		return "", "", fmt.Errorf("target must be user@node-id, got %q", target)
+		return "", "", fmt.Errorf("target must be [user@]node-id, got %q", target)
 	}
 	user := parts[0]
 	if user == "" {
@@ -257,22 +819,53 @@ func parseTarget(target string) (string, string, error) {
 	return user, node, nil
 }
 
-func loadConfig() config.Config {
+// fatal logs err for component and exits.
+func fatal(component string, err error) {
+	logging.Component(component).Error(err.Error())
+	os.Exit(1)
+}
+
+func loadConfig() (config.Config, error) {
 	cfg, err := config.Load()
 	if err != nil {
 		if errors.Is(err, config.ErrNotFound) {
-			return config.Config{}
+			return config.Config{}, nil
 		}
-		log.Printf("[config] warning: %v (continuing with defaults)", err)
-		return config.Config{}
+		return config.Config{}, err
+	}
+	return cfg, nil
+}
+
+// rendezvousOptions parses serverAddr and attaches the token and TLS settings
+// from cfg.
+func rendezvousOptions(serverAddr string, cfg config.Config) (proxy.Options, error) {
+	opts, err := proxy.ParseServerAddr(serverAddr)
+	if err != nil {
+		return proxy.Options{}, err
+	}
+	opts.Token = cfg.Token
+	opts.TLS = transportTLS(cfg.TLS)
+	return opts, nil
+}
+
+func transportTLS(t config.TLSConfig) transport.TLSOptions {
+	return transport.TLSOptions{
+		Enabled:            t.Active(),
+		CA:                 sshconfig.ExpandHome(t.CA),
+		Cert:               sshconfig.ExpandHome(t.Cert),
+		Key:                sshconfig.ExpandHome(t.Key),
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
 	}
-	return cfg
 }
 
 func resolveServer(flagValue string, cfg config.Config, nodeID string) (string, error) {
 	if flagValue != "" {
 		return flagValue, nil
 	}
+	if env := os.Getenv("MSSH_SERVER"); env != "" {
+		return env, nil
+	}
 	if server := cfg.ServerFor(nodeID); server != "" {
 		return server, nil
 	}
@@ -283,6 +876,9 @@ func resolveIdentity(flagValue string, cfg config.Config, nodeID string) string
 	if flagValue != "" {
 		return flagValue
 	}
+	if env := os.Getenv("MSSH_IDENTITY"); env != "" {
+		return env
+	}
 	if identity := cfg.IdentityFor(nodeID); identity != "" {
 		return identity
 	}
@@ -292,6 +888,31 @@ func resolveIdentity(flagValue string, cfg config.Config, nodeID string) string
 	return ""
 }
 
+func resolveAuth(flagValue string, cfg config.Config, nodeID string) ([]string, error) {
+	if flagValue != "" {
+		return parseAuthOrder(strings.Split(flagValue, ","))
+	}
+	return parseAuthOrder(cfg.AuthFor(nodeID))
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func firstNonZero(values ...int) int {
+	for _, v := range values {
+		if v != 0 {
+			return v
+		}
+	}
+	return 0
+}
+
 var nodeIDSanitizePattern = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
 
 func defaultNodeID() string {
@@ -345,8 +966,12 @@ func runConfigInit(existing config.Config) error {
 		return fmt.Errorf("config init requires an interactive terminal")
 	}
 
+	path, err := config.Path()
+	if err != nil {
+		return err
+	}
 	reader := bufio.NewReader(os.Stdin)
-	fmt.Println("This utility will create ~/.mssh/config.yaml")
+	fmt.Printf("This utility will create %s\n", path)
 
 	server := promptServer(reader, existing.Server)
 	identity := promptIdentity(reader, existing.Identity)
@@ -357,10 +982,7 @@ func runConfigInit(existing config.Config) error {
 	if err := config.Save(existing); err != nil {
 		return err
 	}
-	path, err := config.Path()
-	if err == nil {
-		fmt.Printf("Configuration written to %s\n", path)
-	}
+	fmt.Printf("Configuration written to %s\n", path)
 	return nil
 }
 
@@ -397,94 +1019,6 @@ func promptIdentity(reader *bufio.Reader, current string) string {
 	return value
 }
 
-func buildAuthMethods(identity string) ([]ssh.AuthMethod, func(), error) {
-	var auth []ssh.AuthMethod
-	var cleanup func()
-
-	candidates := []string{}
-	if identity != "" {
-		candidates = append(candidates, identity)
-	} else {
-		candidates = append(candidates, defaultIdentityCandidates()...)
-	}
-
-	for _, candidate := range candidates {
-		if candidate == "" {
-			continue
-		}
-		signer, err := loadSigner(candidate)
-		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				continue
-			}
-			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", candidate, err)
-			continue
-		}
-		auth = append(auth, ssh.PublicKeys(signer))
-	}
-
-	if method, agentCleanup, err := sshutil.LoadSSHAgent(); err == nil {
-		auth = append(auth, method)
-		cleanup = agentCleanup
-	}
-
-	if len(auth) == 0 {
-		return nil, cleanup, fmt.Errorf("no SSH authentication methods available; specify --identity or run ssh-add")
-	}
-
-	return auth, cleanup, nil
-}
-
-func defaultIdentityCandidates() []string {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return nil
-	}
-	paths := []string{"id_ed25519", "id_rsa", "id_ecdsa"}
-	var expanded []string
-	for _, name := range paths {
-		expanded = append(expanded, filepath.Join(home, ".ssh", name))
-	}
-	return expanded
-}
-
-func loadSigner(path string) (ssh.Signer, error) {
-	expanded, err := expandPath(path)
-	if err != nil {
-		return nil, err
-	}
-	keyData, err := os.ReadFile(expanded)
-	if err != nil {
-		return nil, err
-	}
-
-	signer, err := ssh.ParsePrivateKey(keyData)
-	if err == nil {
-		return signer, nil
-	}
-
-	var perr *ssh.PassphraseMissingError
-	if !errors.As(err, &perr) {
-		return nil, err
-	}
-
-	const maxAttempts = 3
-	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		passphrase, promptErr := promptPassphrase(expanded)
-		if promptErr != nil {
-			return nil, promptErr
-		}
-		signer, err = ssh.ParsePrivateKeyWithPassphrase(keyData, passphrase)
-		zeroBytes(passphrase)
-		if err == nil {
-			return signer, nil
-		}
-		fmt.Fprintf(os.Stderr, "Incorrect passphrase (attempt %d/%d)\n", attempt, maxAttempts)
-	}
-
-	return nil, fmt.Errorf("failed to decrypt %s: %w", expanded, err)
-}
-
 func expandPath(path string) (string, error) {
 	if strings.HasPrefix(path, "~") {
 		home, err := os.UserHomeDir()
@@ -496,6 +1030,8 @@ func expandPath(path string) (string, error) {
 	return path, nil
 }
 
+// prepareTerminal requests a PTY and puts stdin in raw mode when it is a
+// terminal. The returned function restores the terminal.
 func prepareTerminal(session *ssh.Session) func() {
 	fd := int(os.Stdin.Fd())
 	if !term.IsTerminal(fd) {
@@ -545,24 +1081,3 @@ func prepareTerminal(session *ssh.Session) func() {
 		term.Restore(fd, oldState)
 	}
 }
-
-func promptPassphrase(identityPath string) ([]byte, error) {
-	fd := int(os.Stdin.Fd())
-	if !term.IsTerminal(fd) {
-		return nil, fmt.Errorf("passphrase required for %s but stdin is not a terminal; run ssh-add or specify --identity", identityPath)
-	}
-
-	fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", identityPath)
-	pass, err := term.ReadPassword(fd)
-	fmt.Fprintln(os.Stderr)
-	if err != nil {
-		return nil, err
-	}
-	return pass, nil
-}
-
-func zeroBytes(b []byte) {
-	for i := range b {
-		b[i] = 0
-	}
-}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+func runSFTP(opts clientOptions) error {
+	client, cleanup, err := dialSSH(opts)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		return fmt.Errorf("start sftp subsystem: %w", err)
+	}
+	defer sc.Close()
+
+	remoteDir, err := sc.Getwd()
+	if err != nil {
+		remoteDir = "."
+	}
+	shell := &sftpShell{client: sc, remoteDir: remoteDir, out: os.Stdout}
+	fmt.Fprintf(os.Stdout, "Connected to %s.\n", opts.Node)
+	return shell.run(os.Stdin)
+}
+
+// sftpShell implements a small interactive command loop on top of an SFTP client.
+type sftpShell struct {
+	client    *sftp.Client
+	remoteDir string
+	out       io.Writer
+}
+
+func (s *sftpShell) run(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(s.out, "sftp> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(s.out)
+			return scanner.Err()
+		}
+		fields, err := splitCommand(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(s.out, "%v\n", err)
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		cmd, args := fields[0], fields[1:]
+		if cmd == "exit" || cmd == "quit" || cmd == "bye" {
+			return nil
+		}
+		if err := s.exec(cmd, args); err != nil {
+			fmt.Fprintf(s.out, "%s: %v\n", cmd, err)
+		}
+	}
+}
+
+// splitCommand splits a command line into words like a POSIX shell: single
+// quotes keep everything literally, double quotes keep spaces and honor
+// backslash escapes of '"' and '\\', and a backslash outside quotes escapes
+// the next character.
+func splitCommand(line string) ([]string, error) {
+	var (
+		words   []string
+		current strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range line {
+		switch {
+		case escaped:
+			if quote == '"' && r != '"' && r != '\\' {
+				current.WriteRune('\\')
+			}
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, current.String())
+				current.Reset()
+				inWord = false
+			}
+		default:
+			current.WriteRune(r)
+			inWord = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, current.String())
+	}
+	return words, nil
+}
+
+func (s *sftpShell) exec(cmd string, args []string) error {
+	switch cmd {
+	case "help", "?":
+		s.help()
+		return nil
+	case "pwd":
+		fmt.Fprintf(s.out, "Remote working directory: %s\n", s.remoteDir)
+		return nil
+	case "lpwd":
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "Local working directory: %s\n", wd)
+		return nil
+	case "cd":
+		return s.cd(args)
+	case "lcd":
+		return s.lcd(args)
+	case "ls":
+		return s.ls(args)
+	case "lls":
+		return s.lls(args)
+	case "get":
+		return s.get(args)
+	case "put":
+		return s.put(args)
+	case "rm":
+		if len(args) != 1 {
+			return errors.New("usage: rm <path>")
+		}
+		return s.client.Remove(s.remotePath(args[0]))
+	case "mkdir":
+		if len(args) != 1 {
+			return errors.New("usage: mkdir <path>")
+		}
+		return s.client.Mkdir(s.remotePath(args[0]))
+	case "rmdir":
+		if len(args) != 1 {
+			return errors.New("usage: rmdir <path>")
+		}
+		return s.client.RemoveDirectory(s.remotePath(args[0]))
+	default:
+		return errors.New("unknown command; type 'help' for a list")
+	}
+}
+
+func (s *sftpShell) help() {
+	fmt.Fprint(s.out, `Available commands:
+  cd <path>                Change remote directory
+  lcd <path>               Change local directory
+  ls [path]                List remote directory
+  lls [path]               List local directory
+  pwd                      Print remote working directory
+  lpwd                     Print local working directory
+  get <remote> [local]     Download file
+  put <local> [remote]     Upload file
+  rm <path>                Delete remote file
+  mkdir <path>             Create remote directory
+  rmdir <path>             Remove remote directory
+  exit                     Quit sftp
+`)
+}
+
+func (s *sftpShell) remotePath(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join(s.remoteDir, p)
+}
+
+func (s *sftpShell) cd(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: cd <path>")
+	}
+	target := s.remotePath(args[0])
+	info, err := s.client.Stat(target)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", target)
+	}
+	s.remoteDir = target
+	return nil
+}
+
+func (s *sftpShell) lcd(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: lcd <path>")
+	}
+	target, err := expandPath(args[0])
+	if err != nil {
+		return err
+	}
+	return os.Chdir(target)
+}
+
+func (s *sftpShell) ls(args []string) error {
+	dir := s.remoteDir
+	if len(args) > 0 {
+		dir = s.remotePath(args[0])
+	}
+	entries, err := s.client.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		printEntry(s.out, entry)
+	}
+	return nil
+}
+
+func (s *sftpShell) lls(args []string) error {
+	dir := "."
+	if len(args) > 0 {
+		expanded, err := expandPath(args[0])
+		if err != nil {
+			return err
+		}
+		dir = expanded
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		printEntry(s.out, info)
+	}
+	return nil
+}
+
+func printEntry(w io.Writer, info os.FileInfo) {
+	name := info.Name()
+	if info.IsDir() {
+		name += "/"
+	}
+	fmt.Fprintf(w, "%s %10d %s %s\n", info.Mode(), info.Size(), info.ModTime().Format("Jan _2 15:04"), name)
+}
+
+func (s *sftpShell) get(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: get <remote> [local]")
+	}
+	remote := s.remotePath(args[0])
+	local := path.Base(remote)
+	if len(args) == 2 {
+		expanded, err := expandPath(args[1])
+		if err != nil {
+			return err
+		}
+		local = expanded
+		if info, err := os.Stat(local); err == nil && info.IsDir() {
+			local = filepath.Join(local, path.Base(remote))
+		}
+	}
+
+	src, err := s.client.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	n, err := src.WriteTo(dst)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "Fetched %s to %s (%d bytes)\n", remote, local, n)
+	return nil
+}
+
+func (s *sftpShell) put(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: put <local> [remote]")
+	}
+	local, err := expandPath(args[0])
+	if err != nil {
+		return err
+	}
+	remote := s.remotePath(filepath.Base(local))
+	if len(args) == 2 {
+		remote = s.remotePath(args[1])
+		if info, err := s.client.Stat(remote); err == nil && info.IsDir() {
+			remote = path.Join(remote, filepath.Base(local))
+		}
+	}
+
+	src, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := s.client.Create(remote)
+	if err != nil {
+		return err
+	}
+	n, err := dst.ReadFrom(src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "Uploaded %s to %s (%d bytes)\n", local, remote, n)
+	return nil
+}
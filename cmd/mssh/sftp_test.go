@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"  ls   -l  ", []string{"ls", "-l"}, false},
+		{`get "my file.txt"`, []string{"get", "my file.txt"}, false},
+		{`get 'my file.txt' local`, []string{"get", "my file.txt", "local"}, false},
+		{`get my\ file.txt`, []string{"get", "my file.txt"}, false},
+		{`put "a \"quoted\" name"`, []string{"put", `a "quoted" name`}, false},
+		{`put "back\slash"`, []string{"put", `back\slash`}, false},
+		{`put 'no \escapes'`, []string{"put", `no \escapes`}, false},
+		{`cd ""`, []string{"cd", ""}, false},
+		{`cd dir"with space"s`, []string{"cd", "dirwith spaces"}, false},
+		{`get "open`, nil, true},
+		{`get trailing\`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := splitCommand(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitCommand(%q) err = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitCommand(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/eznix86/mssh/internal/sshconfig"
+	"github.com/eznix86/mssh/internal/sshutil"
+	"github.com/eznix86/mssh/internal/stream"
+)
+
+// openSSHSettings are the ~/.ssh/config directives honored by the built-in client.
+type openSSHSettings struct {
+	User                string
+	IdentityFiles       []string
+	IdentitiesOnly      bool
+	ServerAliveInterval time.Duration
+	ServerAliveCountMax int
+	LocalForwards       []string
+	// Host key checking; see sshutil.HostKeyChecker.
+	UserKnownHostsFiles   []string
+	GlobalKnownHostsFiles []string
+	StrictHostKeyChecking string
+}
+
+// loadOpenSSHSettings reads the OpenSSH client config at path for node.
+// path "none" disables it, mirroring ssh -F none.
+func loadOpenSSHSettings(path, node string) (openSSHSettings, error) {
+	settings := openSSHSettings{
+		ServerAliveCountMax:   3,
+		UserKnownHostsFiles:   sshutil.DefaultUserKnownHostsFiles,
+		GlobalKnownHostsFiles: sshutil.DefaultGlobalKnownHostsFiles,
+	}
+	if path == "none" {
+		return settings, nil
+	}
+	if path == "" {
+		defaultPath, err := sshconfig.DefaultPath()
+		if err != nil {
+			return settings, nil
+		}
+		path = defaultPath
+	}
+
+	cfg, err := sshconfig.Load(sshconfig.ExpandHome(path))
+	if err != nil {
+		return settings, err
+	}
+
+	settings.User = cfg.Get(node, "User")
+	settings.IdentityFiles = cfg.GetAll(node, "IdentityFile")
+	settings.IdentitiesOnly = strings.EqualFold(cfg.Get(node, "IdentitiesOnly"), "yes")
+	settings.LocalForwards = cfg.GetAll(node, "LocalForward")
+	settings.StrictHostKeyChecking = cfg.Get(node, "StrictHostKeyChecking")
+	if files := strings.Fields(cfg.Get(node, "UserKnownHostsFile")); len(files) > 0 {
+		settings.UserKnownHostsFiles = files
+	}
+	if files := strings.Fields(cfg.Get(node, "GlobalKnownHostsFile")); len(files) > 0 {
+		settings.GlobalKnownHostsFiles = files
+	}
+
+	if value := cfg.Get(node, "ServerAliveInterval"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return settings, fmt.Errorf("invalid ServerAliveInterval %q", value)
+		}
+		settings.ServerAliveInterval = time.Duration(seconds) * time.Second
+	}
+	if value := cfg.Get(node, "ServerAliveCountMax"); value != "" {
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return settings, fmt.Errorf("invalid ServerAliveCountMax %q", value)
+		}
+		settings.ServerAliveCountMax = count
+	}
+	return settings, nil
+}
+
+// identityFiles expands the IdentityFile tokens OpenSSH supports most commonly.
+func (s openSSHSettings) identityFiles(remoteUser, node string) []string {
+	return expandTokens(s.IdentityFiles, remoteUser, node)
+}
+
+// knownHostsFiles expands tokens in UserKnownHostsFile; "none" disables it.
+func (s openSSHSettings) knownHostsFiles(remoteUser, node string) []string {
+	if len(s.UserKnownHostsFiles) == 1 && s.UserKnownHostsFiles[0] == "none" {
+		return nil
+	}
+	return expandTokens(s.UserKnownHostsFiles, remoteUser, node)
+}
+
+func expandTokens(files []string, remoteUser, node string) []string {
+	localUser := ""
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+	}
+	home, _ := os.UserHomeDir()
+	replacer := strings.NewReplacer("%%", "%", "%d", home, "%u", localUser, "%r", remoteUser, "%h", node)
+
+	var expanded []string
+	for _, file := range files {
+		expanded = append(expanded, replacer.Replace(file))
+	}
+	return expanded
+}
+
+// startKeepAlive sends keepalive@openssh.com requests every interval and
+// closes the client after countMax consecutive failures.
+func startKeepAlive(client *ssh.Client, interval time.Duration, countMax int) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		missed := 0
+		for range ticker.C {
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				missed++
+				if missed >= countMax {
+					fmt.Fprintf(os.Stderr, "Timeout, server not responding.\r\n")
+					client.Close()
+					return
+				}
+				continue
+			}
+			missed = 0
+		}
+	}()
+}
+
+// startLocalForwards listens on each LocalForward spec and tunnels accepted
+// connections through client. The returned function stops all listeners.
+func startLocalForwards(client *ssh.Client, specs []string) (func(), error) {
+	var listeners []net.Listener
+	stop := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	for _, spec := range specs {
+		local, remote, err := parseForwardSpec(spec)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		listener, err := net.Listen("tcp", local)
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("local forward %s: %w", spec, err)
+		}
+		listeners = append(listeners, listener)
+		go serveLocalForward(client, listener, remote)
+	}
+	return stop, nil
+}
+
+func serveLocalForward(client *ssh.Client, listener net.Listener, remote string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			upstream, err := client.Dial("tcp", remote)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "channel open for %s failed: %v\r\n", remote, err)
+				conn.Close()
+				return
+			}
+			stream.Pipe(conn, upstream)
+		}()
+	}
+}
+
+// parseForwardSpec converts "[bind_address:]port host:hostport" into dialable
+// local and remote addresses.
+func parseForwardSpec(spec string) (string, string, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("invalid LocalForward %q", spec)
+	}
+
+	local := fields[0]
+	if _, err := strconv.Atoi(local); err == nil {
+		local = net.JoinHostPort("localhost", local)
+	} else if _, _, err := net.SplitHostPort(local); err != nil {
+		return "", "", fmt.Errorf("invalid LocalForward listen address %q", fields[0])
+	}
+
+	if _, _, err := net.SplitHostPort(fields[1]); err != nil {
+		return "", "", fmt.Errorf("invalid LocalForward target %q", fields[1])
+	}
+	return local, fields[1], nil
+}
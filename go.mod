@@ -4,13 +4,18 @@ go 1.25.2
 
 require (
 	github.com/alecthomas/kingpin/v2 v2.4.0
-	golang.org/x/crypto v0.46.0
-	golang.org/x/term v0.38.0
+	github.com/pkg/sftp v1.13.11
+	github.com/quic-go/quic-go v0.61.0
+	golang.org/x/crypto v0.54.0
+	golang.org/x/sys v0.47.0
+	golang.org/x/term v0.45.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/alecthomas/units v0.0.0-20211218093645-b94a6e3cc137 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
 	github.com/xhit/go-str2duration/v2 v2.1.0 // indirect
-	golang.org/x/sys v0.39.0 // indirect
+	golang.org/x/net v0.56.0 // indirect
 )
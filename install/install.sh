@@ -114,6 +114,7 @@ Wants=network-online.target
 [Service]
 Type=simple
 ExecStart=$BIN_DIR/mssh server$args_suffix
+ExecReload=/bin/kill -HUP $MAINPID
 Restart=on-failure
 RestartSec=5s
 
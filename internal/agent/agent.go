@@ -1,15 +1,20 @@
 package agent
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/eznix86/mssh/internal/logging"
+	"github.com/eznix86/mssh/internal/protocol"
 	"github.com/eznix86/mssh/internal/stream"
+	"github.com/eznix86/mssh/internal/transport"
 )
 
 // Options defines how the agent connects.
@@ -18,15 +23,43 @@ type Options struct {
 	Port    int
 	NodeID  string
 	SSHPort int
+	// Service names the service exposed on SSHPort; empty registers the
+	// node's default SSH service.
+	Service string
+	// Target is the host:port of the SSH daemon; it defaults to
+	// 127.0.0.1:SSHPort.
+	Target string
+	// Token authenticates the agent to the rendezvous server.
+	Token string
+	TLS   transport.TLSOptions
+	// QUIC reaches the server over QUIC; the control channel and every
+	// session are streams of one connection.
+	QUIC bool
+	// WebSocket is the ws:// or wss:// URL to reach the server through when
+	// only HTTP gets out; every connection is a separate upgrade.
+	WebSocket string
+	// Allow lists the clients that may pair with this registration (see
+	// ValidateAllow); empty admits every client the server lets through.
+	Allow []string
+	// Tags are reported to the server along with host metadata so clients
+	// can filter nodes; Version is the agent version reported with them.
+	Tags    map[string]string
+	Version string
 }
 
-// ParseServerAddr converts host:port into Options with only network fields set.
+// ParseServerAddr converts host:port, quic://host:port or a ws:// or wss://
+// URL into Options with only network fields set.
 func ParseServerAddr(addr string) (Options, error) {
+	wsURL, addr, err := transport.SplitWebSocket(addr)
+	if err != nil {
+		return Options{}, err
+	}
+	addr, quic := transport.SplitScheme(addr)
 	host, port, err := parseAddr(addr)
 	if err != nil {
 		return Options{}, err
 	}
-	return Options{Host: host, Port: port}, nil
+	return Options{Host: host, Port: port, QUIC: quic, WebSocket: wsURL}, nil
 }
 
 func parseAddr(raw string) (string, int, error) {
@@ -43,45 +76,167 @@ func parseAddr(raw string) (string, int, error) {
 
 // Run connects the agent to the rendezvous server and continually proxies SSH traffic.
 func Run(opts Options) error {
+	run(context.Background(), opts)
+	return nil
+}
+
+// run registers opts again after every session or failure until ctx is done.
+// It returns once sessions served over a control channel have ended too.
+func run(ctx context.Context, opts Options) {
+	l := opts.logger()
+	var sessions sync.WaitGroup
+	defer sessions.Wait()
 	for {
-		if err := runOnce(opts); err != nil {
-			log.Printf("[agent] error: %v", err)
+		if err := runOnce(ctx, l, opts, &sessions); err != nil && ctx.Err() == nil {
+			l.Warn("registration ended", logging.Err(err))
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		l.Info("reconnecting to rendezvous server", "delay", "2s")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(2 * time.Second):
 		}
-		log.Printf("[agent] reconnecting to rendezvous server in 2s...")
-		time.Sleep(2 * time.Second)
 	}
 }
 
-func runOnce(opts Options) error {
-	srvAddr := fmt.Sprintf("%s:%d", opts.Host, opts.Port)
-	conn, err := net.Dial("tcp", srvAddr)
+// Registration states; a registration can be canceled only while idle.
+const (
+	stateIdle int32 = iota
+	statePaired
+	stateCanceled
+)
+
+// runOnce registers once. On servers that keep a control channel it serves
+// sessions until the channel closes, adding them to sessions; otherwise it
+// serves at most one session. Canceling ctx closes an idle registration but
+// lets a paired session run to completion.
+func runOnce(ctx context.Context, l *slog.Logger, opts Options, sessions *sync.WaitGroup) error {
+	header := protocol.Header{
+		Type:   protocol.TypeAgent,
+		NodeID: opts.NodeID,
+		Fields: metadata(opts),
+		Caps:   []string{protocol.CapPair, protocol.CapConfirm, protocol.CapControl},
+	}
+	header.Fields[protocol.FieldService] = opts.Service
+	header.Fields[protocol.FieldToken] = opts.Token
+	conn, reader, reply, err := protocol.Negotiate(opts.server(), opts.dial, header)
 	if err != nil {
-		return fmt.Errorf("connect to server: %w", err)
+		return fmt.Errorf("registration failed: %w", err)
 	}
 	defer conn.Close()
-
-	if _, err := fmt.Fprintf(conn, "AGENT %s\n", opts.NodeID); err != nil {
-		return fmt.Errorf("register agent: %w", err)
+	if len(opts.Allow) > 0 && !reply.Has(protocol.CapConfirm) {
+		return fmt.Errorf("server does not report client identities; cannot enforce the allowlist")
+	}
+	if reply.Has(protocol.CapControl) {
+		return serveControl(ctx, l, opts, conn, reader, sessions)
 	}
 
-	reader := bufio.NewReader(conn)
-	response, err := reader.ReadString('\n')
-	if err != nil {
-		return fmt.Errorf("wait ack: %w", err)
+	var state atomic.Int32
+	stop := context.AfterFunc(ctx, func() {
+		if state.CompareAndSwap(stateIdle, stateCanceled) {
+			conn.Close()
+		}
+	})
+	defer stop()
+
+	if reply.Has(protocol.CapPair) {
+		l.Info("registered, waiting for a client", "protocol", reply.Version)
+		pair, err := protocol.ReadHeader(reader)
+		if err != nil {
+			return fmt.Errorf("wait for client: %w", err)
+		}
+		if pair.Type != protocol.TypePair {
+			return fmt.Errorf("unexpected message from server: %s", pair.Type)
+		}
+		if session := pair.Field(protocol.FieldSession); session != "" {
+			l = l.With(logging.KeySessionID, session)
+		}
+		if reply.Has(protocol.CapConfirm) {
+			if !allows(opts.Allow, pair) {
+				io.WriteString(conn, protocol.ErrorReply(reply.Version, "client not allowed"))
+				l.Warn("refused client", "client", clientName(pair))
+				return nil
+			}
+			if _, err := io.WriteString(conn, protocol.Reply{Version: reply.Version}.Encode()); err != nil {
+				return fmt.Errorf("confirm client: %w", err)
+			}
+			l.Info("accepted client", "client", clientName(pair))
+		}
 	}
-	if strings.TrimSpace(response) != "OK" {
-		return fmt.Errorf("registration failed: %s", strings.TrimSpace(response))
+	// Servers without pairing notifications pipe client bytes right away, so
+	// the registration counts as in use from here on.
+	if !state.CompareAndSwap(stateIdle, statePaired) {
+		return ctx.Err()
 	}
 
-	sshConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", opts.SSHPort))
+	sshConn, err := net.Dial("tcp", opts.target())
 	if err != nil {
 		return fmt.Errorf("connect to ssh: %w", err)
 	}
 	defer sshConn.Close()
 
-	log.Printf("[agent] registered as %s, piping traffic", opts.NodeID)
+	l.Info("piping traffic", "target", opts.target())
 	serverConn := stream.Wrap(conn, reader)
-	stream.Pipe(serverConn, sshConn)
-	log.Printf("[agent] client disconnected")
+	stats := stream.Pipe(serverConn, sshConn)
+	l.Info("client disconnected", "bytes_in", stats.AToB, "bytes_out", stats.BToA)
 	return nil
 }
+
+// server returns the server address as configured, to tell servers apart.
+func (o Options) server() string {
+	addr := net.JoinHostPort(o.Host, strconv.Itoa(o.Port))
+	switch {
+	case o.WebSocket != "":
+		return o.WebSocket
+	case o.QUIC:
+		return "quic://" + addr
+	}
+	return addr
+}
+
+// dial connects to the rendezvous server.
+func (o Options) dial() (net.Conn, error) {
+	return o.dialWith(&net.Dialer{})
+}
+
+func (o Options) dialWith(dialer *net.Dialer) (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if o.Token != "" {
+		transport.WarnPlaintextToken(o.server(), o.WebSocket, o.QUIC, o.TLS)
+	}
+	switch {
+	case o.QUIC:
+		conn, err = transport.DialQUIC(o.Host, o.Port, o.TLS)
+	case o.WebSocket != "":
+		conn, err = transport.DialWebSocket(o.WebSocket, o.TLS)
+	default:
+		conn, err = transport.DialWith(dialer, o.Host, o.Port, o.TLS)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect to server: %w", err)
+	}
+	return conn, nil
+}
+
+// target returns the address of the local SSH daemon.
+func (o Options) target() string {
+	if o.Target != "" {
+		return o.Target
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(o.SSHPort))
+}
+
+// logger returns the agent logger tagged with the registration.
+func (o Options) logger() *slog.Logger {
+	l := logging.Component("agent").With(logging.KeyNodeID, o.NodeID)
+	if o.Service != "" {
+		l = l.With(logging.KeyService, o.Service)
+	}
+	return l.With(logging.KeyServer, net.JoinHostPort(o.Host, strconv.Itoa(o.Port)))
+}
@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/eznix86/mssh/internal/protocol"
+)
+
+// Allowlist entry kinds, written as kind:value (e.g. token:alice).
+var allowKinds = map[string]string{
+	"token":       protocol.FieldClientToken,
+	"subject":     protocol.FieldClientSubject,
+	"fingerprint": protocol.FieldClientFingerprint,
+}
+
+// ValidateAllow checks allowlist entries of the form token:<name>,
+// subject:<certificate common name> or fingerprint:SHA256:<base64>.
+func ValidateAllow(entries []string) error {
+	for _, entry := range entries {
+		kind, value, ok := strings.Cut(entry, ":")
+		if _, known := allowKinds[kind]; !ok || !known || value == "" {
+			return fmt.Errorf("invalid allow entry %q (expected token:, subject: or fingerprint:)", entry)
+		}
+	}
+	return nil
+}
+
+// allows reports whether the client described by a PAIR line matches any
+// allowlist entry. An empty allowlist admits everyone.
+func allows(allow []string, pair protocol.Header) bool {
+	if len(allow) == 0 {
+		return true
+	}
+	for _, entry := range allow {
+		kind, value, _ := strings.Cut(entry, ":")
+		field, ok := allowKinds[kind]
+		if ok && protocol.UnescapeValue(pair.Field(field)) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// clientName describes the client of a PAIR line for logs.
+func clientName(pair protocol.Header) string {
+	var parts []string
+	for _, kind := range []string{"token", "subject", "fingerprint"} {
+		if value := protocol.UnescapeValue(pair.Field(allowKinds[kind])); value != "" {
+			parts = append(parts, kind+":"+value)
+		}
+	}
+	if len(parts) == 0 {
+		return "anonymous client"
+	}
+	return strings.Join(parts, " ")
+}
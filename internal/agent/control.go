@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eznix86/mssh/internal/logging"
+	"github.com/eznix86/mssh/internal/protocol"
+	"github.com/eznix86/mssh/internal/punch"
+	"github.com/eznix86/mssh/internal/stream"
+)
+
+// dataReplyTimeout bounds the wait for the server to accept a data
+// connection, so a stalled server cannot hold the local service connection.
+const dataReplyTimeout = 30 * time.Second
+
+// serveControl answers PAIR messages on a control channel until it closes
+// or ctx is canceled. Each accepted client gets its own data connection and
+// pipe, tracked in sessions so they outlive the channel.
+func serveControl(ctx context.Context, l *slog.Logger, opts Options, conn net.Conn, reader *bufio.Reader, sessions *sync.WaitGroup) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var wmu sync.Mutex
+	refuse := func(session, reason string) {
+		msg := protocol.Header{
+			Version: protocol.Version2,
+			Type:    protocol.TypeRefuse,
+			NodeID:  opts.NodeID,
+			Fields: map[string]string{
+				protocol.FieldSession: session,
+				protocol.FieldReason:  reason,
+			},
+		}
+		wmu.Lock()
+		io.WriteString(conn, msg.Encode())
+		wmu.Unlock()
+	}
+
+	l.Info("registered, waiting for clients", "protocol", protocol.Version2, "control", true)
+	for {
+		pair, err := protocol.ReadHeader(reader)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("control channel: %w", err)
+		}
+		if pair.Type != protocol.TypePair {
+			return fmt.Errorf("unexpected message from server: %s", pair.Type)
+		}
+		session := pair.Field(protocol.FieldSession)
+		sl := l.With(logging.KeySessionID, session)
+		if !allows(opts.Allow, pair) {
+			refuse(session, "client not allowed")
+			sl.Warn("refused client", "client", clientName(pair))
+			continue
+		}
+		sl.Info("accepted client", "client", clientName(pair))
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			if err := serveSession(sl, opts, session, pair.Has(protocol.CapDirect)); err != nil {
+				refuse(session, "agent cannot reach its service")
+				sl.Warn("session failed", logging.Err(err))
+			}
+		}()
+	}
+}
+
+// serveSession connects the local service to a new data connection for
+// session and pipes them. When the PAIR message says the client asked for a
+// direct connection, the data connection is made from a punch endpoint and
+// replaced by the direct connection if one opens. An error means the server
+// never accepted the data connection, so the client is still waiting for an
+// answer.
+func serveSession(l *slog.Logger, opts Options, session string, direct bool) error {
+	sshConn, err := net.Dial("tcp", opts.target())
+	if err != nil {
+		return fmt.Errorf("connect to ssh: %w", err)
+	}
+	defer sshConn.Close()
+
+	header := protocol.Header{
+		Version: protocol.Version2,
+		Type:    protocol.TypeData,
+		NodeID:  opts.NodeID,
+		Fields: map[string]string{
+			protocol.FieldService: opts.Service,
+			protocol.FieldToken:   opts.Token,
+			protocol.FieldSession: session,
+		},
+	}
+	var (
+		conn net.Conn
+		ep   *punch.Endpoint
+	)
+	// Punching needs a TCP port shared with the server connection.
+	if direct && !opts.QUIC && opts.WebSocket == "" {
+		ep, _ = punch.Listen()
+	}
+	if ep != nil {
+		defer ep.Close()
+		header.Caps = []string{protocol.CapDirect}
+		header.Fields[protocol.FieldAddrs] = protocol.FormatAddrs(ep.Addrs())
+		conn, err = opts.dialWith(ep.Dialer())
+	} else {
+		conn, err = opts.dial()
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(dataReplyTimeout))
+	if _, err := io.WriteString(conn, header.Encode()); err != nil {
+		conn.Close()
+		return fmt.Errorf("send data header: %w", err)
+	}
+	serverConn := stream.New(conn)
+	reply, err := protocol.ReadReply(serverConn)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("open data connection: %w", err)
+	}
+
+	peer := serverConn
+	if ep != nil && reply.Has(protocol.CapDirect) {
+		peer, err = punch.Respond(ep, serverConn, protocol.ParseAddrs(reply.Field(protocol.FieldPeerAddrs)), session)
+		if err != nil {
+			// The client already has its OK; closing is all that is left.
+			serverConn.Close()
+			l.Warn("session failed while choosing the connection path", logging.Err(err))
+			return nil
+		}
+		if peer != serverConn {
+			l.Info("connected directly to client", logging.KeyRemoteAddr, peer.RemoteAddr().String())
+		}
+	}
+
+	l.Info("piping traffic", "target", opts.target())
+	stats := stream.Pipe(peer, sshConn)
+	l.Info("client disconnected", "bytes_in", stats.AToB, "bytes_out", stats.BToA)
+	return nil
+}
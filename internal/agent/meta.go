@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/eznix86/mssh/internal/protocol"
+)
+
+// ParseTags parses --tag entries of the form key=value.
+func ParseTags(entries []string) (map[string]string, error) {
+	tags := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tag %q (expected key=value)", entry)
+		}
+		if err := protocol.ValidateTag(key, value); err != nil {
+			return nil, err
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// metadata describes the host for the registration header. Values are
+// escaped for the wire; facts that cannot be read are left out.
+func metadata(opts Options) map[string]string {
+	meta := map[string]string{
+		protocol.FieldOS:      runtime.GOOS,
+		protocol.FieldArch:    runtime.GOARCH,
+		protocol.FieldVersion: opts.Version,
+		protocol.FieldTags:    protocol.FormatTags(opts.Tags),
+	}
+	if host, err := os.Hostname(); err == nil {
+		meta[protocol.FieldHostname] = host
+	}
+	meta[protocol.FieldIPs] = strings.Join(hostIPs(), ",")
+	if uptime, ok := hostUptime(); ok {
+		meta[protocol.FieldUptime] = strconv.FormatInt(uptime, 10)
+	}
+	for key, value := range meta {
+		meta[key] = protocol.EscapeValue(value)
+	}
+	return meta
+}
+
+// hostIPs returns the addresses of the interfaces that are up, skipping
+// loopback and link-local ones.
+func hostIPs() []string {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ips []string
+	for _, iface := range ifs {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+	return ips
+}
+
+// hostUptime reads the system uptime in seconds where /proc is available.
+func hostUptime() (int64, bool) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, false
+	}
+	first, _, _ := strings.Cut(string(data), " ")
+	seconds, err := strconv.ParseFloat(first, 64)
+	if err != nil {
+		return 0, false
+	}
+	return int64(seconds), true
+}
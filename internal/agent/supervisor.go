@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Supervisor runs one registration loop per Options. Apply replaces the set
+// of registrations: unchanged ones keep running, removed or changed ones are
+// stopped once idle, and a session in progress is never interrupted.
+type Supervisor struct {
+	mu    sync.Mutex
+	loops map[string]loop
+	wg    sync.WaitGroup
+}
+
+type loop struct {
+	opts   Options
+	cancel context.CancelFunc
+}
+
+// NewSupervisor returns a Supervisor with no registrations.
+func NewSupervisor() *Supervisor {
+	return &Supervisor{loops: make(map[string]loop)}
+}
+
+// Apply starts loops for new registrations and stops those not in regs.
+func (s *Supervisor) Apply(regs []Options) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[string]Options, len(regs))
+	for _, opts := range regs {
+		wanted[opts.key()] = opts
+	}
+	for key, l := range s.loops {
+		if _, ok := wanted[key]; !ok {
+			l.opts.logger().Info("removing registration")
+			l.cancel()
+			delete(s.loops, key)
+		}
+	}
+	for key, opts := range wanted {
+		if _, running := s.loops[key]; running {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		s.loops[key] = loop{opts: opts, cancel: cancel}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			run(ctx, opts)
+		}()
+	}
+}
+
+// key identifies a registration; any change to its options yields a new key.
+func (o Options) key() string {
+	return fmt.Sprintf("%#v", o)
+}
+
+// Wait blocks until every loop has stopped.
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
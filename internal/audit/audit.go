@@ -0,0 +1,392 @@
+// Package audit writes the rendezvous server's audit trail as JSON lines.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eznix86/mssh/internal/logging"
+)
+
+// Event kinds.
+const (
+	KindSession  = "session"
+	KindRejected = "rejected"
+)
+
+// Event is one audit record. Session events are written when a pairing ends;
+// rejected events for every handshake answered with an ERROR.
+type Event struct {
+	Time        time.Time `json:"time"`
+	Kind        string    `json:"event"`
+	Type        string    `json:"type,omitempty"`
+	Node        string    `json:"node,omitempty"`
+	Session     string    `json:"session,omitempty"`
+	Token       string    `json:"token,omitempty"`
+	Subject     string    `json:"subject,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	RemoteAddr  string    `json:"remote_addr,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+
+	Start      time.Time `json:"start,omitzero"`
+	DurationMS int64     `json:"duration_ms,omitempty"`
+	BytesIn    int64     `json:"bytes_in,omitempty"`
+	BytesOut   int64     `json:"bytes_out,omitempty"`
+	// End says how a session finished: client_closed, agent_closed or error.
+	End string `json:"end,omitempty"`
+	// Direct is set when client and agent moved the session to a direct
+	// connection; the record then only covers its setup on the relay.
+	Direct bool `json:"direct,omitempty"`
+
+	// Prev and Hash chain records together when hash chaining is enabled:
+	// Hash is the HMAC-SHA256, keyed with Options.HashKey, of Prev followed
+	// by the record encoded without Hash. Hash must stay the last field.
+	Prev string `json:"prev,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// Options selects where the audit trail goes. With neither File nor Syslog
+// set, auditing is off.
+type Options struct {
+	File string `yaml:"file,omitempty"`
+	// MaxSizeMB rotates File once it grows past this size; 0 disables rotation.
+	MaxSizeMB int `yaml:"max-size-mb,omitempty"`
+	// MaxFiles is the number of rotated files kept (File.1 ... File.N).
+	MaxFiles int `yaml:"max-files,omitempty"`
+	// Syslog is "local" for the local daemon or udp://host:port / tcp://host:port.
+	Syslog    string `yaml:"syslog,omitempty"`
+	HashChain bool   `yaml:"hash-chain,omitempty"`
+	// HashKey keys the hash chain, so records cannot be rewritten and
+	// rechained without it. Required with HashChain.
+	HashKey string `yaml:"hash-key,omitempty"`
+}
+
+// ErrNoHashKey is returned when hash chaining is enabled without a key.
+var ErrNoHashKey = errors.New("audit: hash-chain needs a hash-key")
+
+// Logger writes events to the configured sinks. It is safe for concurrent
+// use and can be reconfigured while running.
+type Logger struct {
+	mu     sync.Mutex
+	opts   Options
+	file   *os.File
+	size   int64
+	syslog *syslog.Writer
+	prev   string
+}
+
+// New returns a Logger with no sinks.
+func New() *Logger {
+	return &Logger{}
+}
+
+// Configure switches to opts, closing the previous sinks. With hash chaining
+// the chain resumes from the last record already in the file.
+func (l *Logger) Configure(opts Options) error {
+	if opts.HashChain && opts.HashKey == "" {
+		return ErrNoHashKey
+	}
+	var file *os.File
+	var size int64
+	var prev string
+	if opts.File != "" {
+		var err error
+		if prev, err = lastHash(opts.File); err != nil {
+			return err
+		}
+		// A file that was just rotated continues the chain of its predecessor.
+		if prev == "" {
+			if prev, err = lastHash(opts.File + ".1"); err != nil {
+				return err
+			}
+		}
+		if file, err = os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+			return err
+		}
+		if info, err := file.Stat(); err == nil {
+			size = info.Size()
+		}
+		// Start on a fresh line after a record cut short by a crash.
+		if size > 0 && !endsWithNewline(opts.File, size) {
+			if n, err := file.Write([]byte("\n")); err == nil {
+				size += int64(n)
+			}
+		}
+	}
+	var sys *syslog.Writer
+	if opts.Syslog != "" {
+		var err error
+		if sys, err = dialSyslog(opts.Syslog); err != nil {
+			if file != nil {
+				file.Close()
+			}
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeSinks()
+	l.opts, l.file, l.size, l.syslog = opts, file, size, sys
+	if opts.File != "" {
+		l.prev = prev
+	}
+	return nil
+}
+
+// Log records ev, filling in the time and the hash chain.
+func (l *Logger) Log(ev Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil && l.syslog == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	if l.opts.HashChain {
+		ev.Prev = l.prev
+		body, _ := json.Marshal(ev)
+		ev.Hash = chainHash([]byte(l.opts.HashKey), ev.Prev, body)
+		l.prev = ev.Hash
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	if l.file != nil {
+		l.rotateIfNeeded(int64(len(line)) + 1)
+		n, err := l.file.Write(append(line, '\n'))
+		l.size += int64(n)
+		if err != nil {
+			logger().Error("write failed", "file", l.opts.File, logging.Err(err))
+		}
+	}
+	if l.syslog != nil {
+		if err := l.syslog.Info(string(line)); err != nil {
+			logger().Error("syslog write failed", logging.Err(err))
+		}
+	}
+}
+
+// Close releases the sinks.
+func (l *Logger) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeSinks()
+}
+
+func (l *Logger) closeSinks() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	if l.syslog != nil {
+		l.syslog.Close()
+		l.syslog = nil
+	}
+}
+
+// rotateIfNeeded shifts File to File.1 (and so on) before a write that would
+// exceed the size limit. The hash chain continues into the new file.
+func (l *Logger) rotateIfNeeded(next int64) {
+	limit := int64(l.opts.MaxSizeMB) << 20
+	if limit <= 0 || l.size == 0 || l.size+next <= limit {
+		return
+	}
+	keep := l.opts.MaxFiles
+	if keep <= 0 {
+		keep = 1
+	}
+	l.file.Close()
+	if err := os.Remove(fmt.Sprintf("%s.%d", l.opts.File, keep)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger().Error("rotation failed", "file", l.opts.File, logging.Err(err))
+	}
+	for i := keep - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", l.opts.File, i), fmt.Sprintf("%s.%d", l.opts.File, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger().Error("rotation failed", "file", l.opts.File, logging.Err(err))
+		}
+	}
+	if err := os.Rename(l.opts.File, l.opts.File+".1"); err != nil {
+		// Keep appending to the current file rather than losing records.
+		logger().Error("rotation failed", "file", l.opts.File, logging.Err(err))
+	}
+
+	file, err := os.OpenFile(l.opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		logger().Error("reopen failed", "file", l.opts.File, logging.Err(err))
+		l.file = nil
+		return
+	}
+	l.file, l.size = file, 0
+	if info, err := file.Stat(); err == nil {
+		l.size = info.Size()
+	}
+}
+
+// chainHash returns the hash of a record given its encoding without Hash.
+func chainHash(key []byte, prev string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(prev))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyFiles checks the hash chain through the given files, oldest first
+// (e.g. audit.jsonl.2, audit.jsonl.1, audit.jsonl), and returns the number
+// of records checked. The first record's prev is taken as given, since the
+// records before it may have been rotated away. Unparsable lines, as left
+// by a crash mid-write, are skipped.
+func VerifyFiles(key []byte, paths ...string) (int, error) {
+	var prev string
+	records := 0
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return records, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 16<<20)
+		lineNo := 0
+		for scanner.Scan() {
+			lineNo++
+			line := bytes.TrimSpace(scanner.Bytes())
+			var ev Event
+			if len(line) == 0 || json.Unmarshal(line, &ev) != nil {
+				continue
+			}
+			if err := verifyRecord(key, prev, records == 0, line, ev); err != nil {
+				f.Close()
+				return records, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+			}
+			prev = ev.Hash
+			records++
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return records, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return records, nil
+}
+
+func verifyRecord(key []byte, prev string, first bool, line []byte, ev Event) error {
+	if ev.Hash == "" {
+		return errors.New("record has no hash")
+	}
+	if !first && ev.Prev != prev {
+		return errors.New("prev does not match the previous record; records were removed or reordered")
+	}
+	// The record was hashed as encoded before Hash, its last field, was added.
+	suffix := []byte(`,"hash":"` + ev.Hash + `"}`)
+	if !bytes.HasSuffix(line, suffix) {
+		return errors.New("hash is not the last field")
+	}
+	body := append(bytes.TrimSuffix(line, suffix), '}')
+	if !hmac.Equal([]byte(chainHash(key, ev.Prev, body)), []byte(ev.Hash)) {
+		return errors.New("hash mismatch; the record was modified or the key is wrong")
+	}
+	return nil
+}
+
+// lastHash returns the hash of the last record in path, or "" if there is
+// none. Unparsable lines at the end, as left by a crash mid-write, are
+// skipped with a warning.
+func lastHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// Read backwards in chunks; buf holds the not yet examined bytes that
+	// end where the previously examined line began.
+	const chunk = 64 << 10
+	offset := info.Size()
+	var buf []byte
+	skipped := 0
+	for {
+		i := bytes.LastIndexByte(buf, '\n')
+		if i < 0 && offset > 0 {
+			n := min(chunk, offset)
+			offset -= n
+			more := make([]byte, n, n+int64(len(buf)))
+			if _, err := f.ReadAt(more, offset); err != nil {
+				return "", err
+			}
+			buf = append(more, buf...)
+			continue
+		}
+		line := bytes.TrimSpace(buf[i+1:])
+		if len(line) > 0 {
+			var ev Event
+			if err := json.Unmarshal(line, &ev); err == nil {
+				if skipped > 0 {
+					logger().Warn("skipped invalid records at the end of the audit file", "file", path, "records", skipped)
+				}
+				return ev.Hash, nil
+			}
+			skipped++
+		}
+		if i < 0 {
+			break
+		}
+		buf = buf[:i]
+	}
+	if skipped > 0 {
+		logger().Warn("no valid record in the audit file; starting a new hash chain", "file", path, "records", skipped)
+	}
+	return "", nil
+}
+
+func endsWithNewline(path string, size int64) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, size-1); err != nil {
+		return true
+	}
+	return last[0] == '\n'
+}
+
+// logger reports problems with the audit sinks themselves.
+func logger() *slog.Logger {
+	return logging.Component("audit")
+}
+
+func dialSyslog(target string) (*syslog.Writer, error) {
+	const priority = syslog.LOG_INFO | syslog.LOG_AUTH
+	if target == "local" {
+		return syslog.New(priority, "mssh-audit")
+	}
+	network, addr, ok := strings.Cut(target, "://")
+	if !ok || (network != "udp" && network != "tcp") {
+		return nil, fmt.Errorf("audit: syslog must be \"local\" or udp://host:port or tcp://host:port, got %q", target)
+	}
+	return syslog.Dial(network, addr, priority, "mssh-audit")
+}
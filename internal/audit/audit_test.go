@@ -0,0 +1,220 @@
+package audit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testKey = "k3y"
+
+func chained(path string) Options {
+	return Options{File: path, HashChain: true, HashKey: testKey}
+}
+
+// logN writes n events with reasons starting at first.
+func logN(t *testing.T, l *Logger, first, n int, reason string) {
+	t.Helper()
+	for i := first; i < first+n; i++ {
+		l.Log(Event{Kind: KindRejected, Node: "web-1", Reason: reason + strings.Repeat("x", i%3)})
+	}
+}
+
+func TestVerifyFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		// tamper edits the file's lines; nil leaves it alone.
+		tamper  func(lines []string) []string
+		key     string
+		wantErr string
+	}{
+		{name: "intact", key: testKey},
+		{name: "wrong key", key: "other", wantErr: "hash mismatch"},
+		{
+			name:    "edited record",
+			tamper:  func(l []string) []string { l[1] = strings.Replace(l[1], "web-1", "web-2", 1); return l },
+			key:     testKey,
+			wantErr: ":2: hash mismatch",
+		},
+		{
+			name:    "deleted record",
+			tamper:  func(l []string) []string { return append(l[:1], l[2:]...) },
+			key:     testKey,
+			wantErr: ":2: prev does not match",
+		},
+		{
+			name:    "reordered records",
+			tamper:  func(l []string) []string { l[1], l[2] = l[2], l[1]; return l },
+			key:     testKey,
+			wantErr: ":2: prev does not match",
+		},
+		{
+			name:    "hash removed",
+			tamper:  func(l []string) []string { l[2] = l[2][:strings.Index(l[2], `,"hash"`)] + "}"; return l },
+			key:     testKey,
+			wantErr: ":3: record has no hash",
+		},
+		{
+			// Dropping the oldest records, as rotation does, keeps the rest valid.
+			name:   "leading records removed",
+			tamper: func(l []string) []string { return l[2:] },
+			key:    testKey,
+		},
+		{
+			name:   "truncated last line is skipped",
+			tamper: func(l []string) []string { return append(l, `{"time":"2026`) },
+			key:    testKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			l := New()
+			if err := l.Configure(chained(path)); err != nil {
+				t.Fatal(err)
+			}
+			logN(t, l, 0, 4, "forbidden")
+			l.Close()
+			if tt.tamper != nil {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				lines := tt.tamper(strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"))
+				if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := VerifyFiles([]byte(tt.key), path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("VerifyFiles: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigureNeedsHashKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := New().Configure(Options{File: path, HashChain: true}); !errors.Is(err, ErrNoHashKey) {
+		t.Fatalf("err = %v, want ErrNoHashKey", err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	tests := []struct {
+		name string
+		// between runs on the file written by the first Logger.
+		between func(t *testing.T, path string)
+		// files lists the chain to verify, oldest first.
+		files []string
+	}{
+		{
+			name:  "same file",
+			files: []string{""},
+		},
+		{
+			// The server was restarted right after a rotation, before the new
+			// file got its first record.
+			name: "rotated file",
+			between: func(t *testing.T, path string) {
+				if err := os.Rename(path, path+".1"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			files: []string{".1", ""},
+		},
+		{
+			name: "record cut short by a crash",
+			between: func(t *testing.T, path string) {
+				f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteString(`{"time":"2026-10-18T09:`)
+				f.Close()
+			},
+			files: []string{""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			first := New()
+			if err := first.Configure(chained(path)); err != nil {
+				t.Fatal(err)
+			}
+			logN(t, first, 0, 3, "before")
+			first.Close()
+			if tt.between != nil {
+				tt.between(t, path)
+			}
+
+			second := New()
+			if err := second.Configure(chained(path)); err != nil {
+				t.Fatal(err)
+			}
+			logN(t, second, 3, 2, "after")
+			second.Close()
+
+			var files []string
+			for _, suffix := range tt.files {
+				files = append(files, path+suffix)
+			}
+			records, err := VerifyFiles([]byte(testKey), files...)
+			if err != nil {
+				t.Fatalf("VerifyFiles: %v", err)
+			}
+			if records != 5 {
+				t.Errorf("verified %d records, want 5", records)
+			}
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l := New()
+	opts := chained(path)
+	opts.MaxSizeMB, opts.MaxFiles = 1, 2
+	if err := l.Configure(opts); err != nil {
+		t.Fatal(err)
+	}
+	// Each record is a bit over 300 KiB, so every fourth one starts a file.
+	big := strings.Repeat("r", 300<<10)
+	logN(t, l, 0, 13, big)
+	l.Close()
+
+	for _, suffix := range []string{"", ".1", ".2"} {
+		info, err := os.Stat(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1<<20 {
+			t.Errorf("%s is %d bytes, over the limit", path+suffix, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s.3 exists beyond max-files: %v", path, err)
+	}
+	// 13 records in files of 3: the current file holds 1, .1 and .2 hold 3
+	// each and the oldest 6 were dropped.
+	records, err := VerifyFiles([]byte(testKey), path+".2", path+".1", path)
+	if err != nil {
+		t.Fatalf("VerifyFiles: %v", err)
+	}
+	if records != 7 {
+		t.Errorf("verified %d records, want 7", records)
+	}
+	if _, err := VerifyFiles([]byte(testKey), path+".1", path+".2", path); err == nil {
+		t.Error("files out of order verified")
+	}
+}
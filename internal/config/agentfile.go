@@ -0,0 +1,57 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AgentFile is the file read by 'mssh agent --config'. Top-level server,
+// token, tls and allow apply to every registration that does not set its own;
+// top-level tags are merged with each registration's.
+type AgentFile struct {
+	Server        string            `yaml:"server,omitempty"`
+	Token         string            `yaml:"token,omitempty"`
+	TLS           TLSConfig         `yaml:"tls,omitempty"`
+	Allow         []string          `yaml:"allow,omitempty"`
+	Tags          map[string]string `yaml:"tags,omitempty"`
+	Registrations []Registration    `yaml:"registrations"`
+}
+
+// Registration is one node-id (and optional service) announced by the agent.
+type Registration struct {
+	NodeID  string    `yaml:"node-id"`
+	Service string    `yaml:"service,omitempty"`
+	Server  string    `yaml:"server,omitempty"`
+	Token   string    `yaml:"token,omitempty"`
+	TLS     TLSConfig `yaml:"tls,omitempty"`
+	// Target is the host:port of the SSH daemon; SSHPort is shorthand for
+	// 127.0.0.1:<port>.
+	Target  string `yaml:"target,omitempty"`
+	SSHPort int    `yaml:"ssh-port,omitempty"`
+	// Allow replaces the file-level allowlist for this registration.
+	Allow []string `yaml:"allow,omitempty"`
+	// Tags override file-level tags with the same key.
+	Tags map[string]string `yaml:"tags,omitempty"`
+}
+
+// LoadAgentFile reads an agent config. Unknown keys are rejected so typos do
+// not silently drop a registration.
+func LoadAgentFile(path string) (AgentFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return AgentFile{}, err
+	}
+	var file AgentFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return AgentFile{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(file.Registrations) == 0 {
+		return AgentFile{}, fmt.Errorf("%s: no registrations", path)
+	}
+	return file, nil
+}
@@ -2,8 +2,12 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -15,44 +19,224 @@ var ErrNotFound = errors.New("config not found")
 type Config struct {
 	Server   string               `yaml:"server"`
 	Identity string               `yaml:"identity,omitempty"`
+	User     string               `yaml:"user,omitempty"`
+	Auth     []string             `yaml:"auth,omitempty"`
 	Nodes    map[string]NodeEntry `yaml:"nodes,omitempty"`
+	// CertAuthorities holds host CA public keys or paths to files containing them.
+	CertAuthorities []string `yaml:"cert-authorities,omitempty"`
+	// Token authenticates to the rendezvous server.
+	Token string    `yaml:"token,omitempty"`
+	TLS   TLSConfig `yaml:"tls,omitempty"`
+	// Profile names the entry of Profiles used when none is selected explicitly.
+	Profile  string             `yaml:"profile,omitempty"`
+	Profiles map[string]Profile `yaml:"profiles,omitempty"`
+	// Agent holds defaults for 'mssh agent'. 'mssh server' reads its own
+	// file (--config).
+	Agent AgentConfig `yaml:"agent,omitempty"`
+}
+
+// AgentConfig holds defaults for 'mssh agent'; flags take precedence.
+type AgentConfig struct {
+	NodeID  string `yaml:"node-id,omitempty"`
+	Server  string `yaml:"server,omitempty"`
+	SSHPort int    `yaml:"ssh-port,omitempty"`
+	Service string `yaml:"service,omitempty"`
+	// Allow limits which clients may pair; see 'mssh agent --allow'.
+	Allow []string `yaml:"allow,omitempty"`
+	// Tags are reported to the server; see 'mssh agent --tag'.
+	Tags map[string]string `yaml:"tags,omitempty"`
+}
+
+// Profile groups the settings for one rendezvous environment (e.g. prod or
+// staging). Non-empty values replace the top-level ones when it is active.
+type Profile struct {
+	Server   string    `yaml:"server,omitempty"`
+	Identity string    `yaml:"identity,omitempty"`
+	Auth     []string  `yaml:"auth,omitempty"`
+	Token    string    `yaml:"token,omitempty"`
+	TLS      TLSConfig `yaml:"tls,omitempty"`
+}
+
+// TLSConfig describes how to reach a server that speaks TLS, either natively
+// or through a terminating proxy.
+type TLSConfig struct {
+	Enabled            bool   `yaml:"enabled,omitempty"`
+	CA                 string `yaml:"ca,omitempty"`
+	Cert               string `yaml:"cert,omitempty"`
+	Key                string `yaml:"key,omitempty"`
+	ServerName         string `yaml:"server-name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure-skip-verify,omitempty"`
+}
+
+// Active reports whether TLS should be used; any setting implies it.
+func (t TLSConfig) Active() bool {
+	return t.Enabled || t.CA != "" || t.Cert != "" || t.ServerName != "" || t.InsecureSkipVerify
+}
+
+// ErrUnknownProfile is returned when a profile name is not defined.
+var ErrUnknownProfile = errors.New("unknown profile")
+
+// WithProfile returns the config with the named profile applied on top of
+// the top-level settings. An empty name selects c.Profile; if that is empty
+// too, c is returned unchanged.
+func (c Config) WithProfile(name string) (Config, error) {
+	if name == "" {
+		name = c.Profile
+	}
+	if name == "" {
+		return c, nil
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return c, fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+	}
+	c.Profile = name
+	if p.Server != "" {
+		c.Server = p.Server
+	}
+	if p.Identity != "" {
+		c.Identity = p.Identity
+	}
+	if len(p.Auth) > 0 {
+		c.Auth = p.Auth
+	}
+	if p.Token != "" {
+		c.Token = p.Token
+	}
+	if p.TLS != (TLSConfig{}) {
+		c.TLS = p.TLS
+	}
+	return c, nil
 }
 
 // NodeEntry contains optional overrides for a specific node-id.
 type NodeEntry struct {
-	Server   string `yaml:"server,omitempty"`
-	Identity string `yaml:"identity,omitempty"`
+	Server   string   `yaml:"server,omitempty"`
+	Identity string   `yaml:"identity,omitempty"`
+	Auth     []string `yaml:"auth,omitempty"`
+	// User is the login used when the target omits user@.
+	User string `yaml:"user,omitempty"`
+	// Alias is a friendly name that can be typed instead of the node-id.
+	Alias string `yaml:"alias,omitempty"`
+	// Service selects which service registered by the node's agent to reach.
+	Service string `yaml:"service,omitempty"`
+	// Command runs instead of an interactive shell when none is given.
+	Command string `yaml:"command,omitempty"`
 }
 
-// Path returns the path to the config file.
+// SystemPath is the system-wide config merged underneath the user's file.
+var SystemPath = "/etc/mssh/config.yaml"
+
+// Path returns the path to the user config file: $MSSH_CONFIG when set,
+// otherwise ~/.mssh/config.yaml if it exists, otherwise
+// $XDG_CONFIG_HOME/mssh/config.yaml (~/.config when unset) if it exists.
+// New files go to the XDG location only when XDG_CONFIG_HOME is set.
 func Path() (string, error) {
+	if path := os.Getenv("MSSH_CONFIG"); path != "" {
+		return path, nil
+	}
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(home, ".mssh", "config.yaml"), nil
+	legacy := filepath.Join(home, ".mssh", "config.yaml")
+	if _, err := os.Stat(legacy); err == nil {
+		return legacy, nil
+	}
+	xdgHome := os.Getenv("XDG_CONFIG_HOME")
+	xdgDir := xdgHome
+	if xdgDir == "" {
+		xdgDir = filepath.Join(home, ".config")
+	}
+	xdg := filepath.Join(xdgDir, "mssh", "config.yaml")
+	if _, err := os.Stat(xdg); err == nil || xdgHome != "" {
+		return xdg, nil
+	}
+	return legacy, nil
 }
 
-// Load reads the config file.
+// Load reads the system config and the user config on top of it. Top-level
+// values in the user file win; entries under nodes and profiles are replaced
+// as a whole. ErrNotFound is returned only when neither file exists.
 func Load() (Config, error) {
+	var cfg Config
+	found := false
+	if err := readInto(SystemPath, &cfg); err == nil {
+		found = true
+	} else if !errors.Is(err, ErrNotFound) {
+		return Config{}, err
+	}
+
 	path, err := Path()
 	if err != nil {
 		return Config{}, err
 	}
-	data, err := os.ReadFile(path)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return Config{}, ErrNotFound
+	if err := readInto(path, &cfg); err == nil {
+		found = true
+	} else if !errors.Is(err, ErrNotFound) {
+		return Config{}, err
+	}
+	if !found {
+		return Config{}, ErrNotFound
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// Validate checks settings that would otherwise resolve ambiguously: every
+// alias must name exactly one node and must not shadow another node-id.
+func (c Config) Validate() error {
+	owners := map[string]string{}
+	nodeIDs := make([]string, 0, len(c.Nodes))
+	for nodeID := range c.Nodes {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	for _, nodeID := range nodeIDs {
+		alias := c.Nodes[nodeID].Alias
+		if alias == "" || IsPattern(nodeID) {
+			continue
+		}
+		if owner, ok := owners[alias]; ok {
+			return fmt.Errorf("alias %q is used by both %s and %s", alias, owner, nodeID)
+		}
+		if _, ok := c.Nodes[alias]; ok && alias != nodeID {
+			return fmt.Errorf("alias %q of %s is also a node-id", alias, nodeID)
 		}
+		owners[alias] = nodeID
+	}
+	return nil
+}
+
+// LoadUser reads only the user config file, for commands that write it back.
+func LoadUser() (Config, error) {
+	path, err := Path()
+	if err != nil {
 		return Config{}, err
 	}
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	if err := readInto(path, &cfg); err != nil {
 		return Config{}, err
 	}
 	return cfg, nil
 }
 
+func readInto(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
 // Save writes the config to disk, creating the directory if needed.
 func Save(cfg Config) error {
 	path, err := Path()
@@ -72,20 +256,133 @@ func Save(cfg Config) error {
 
 // ServerFor returns the server override for a node or the global default.
 func (c Config) ServerFor(nodeID string) string {
-	if nodeID != "" && c.Nodes != nil {
-		if entry, ok := c.Nodes[nodeID]; ok && entry.Server != "" {
-			return entry.Server
-		}
-	}
-	return c.Server
+	return c.nodeValue(nodeID, c.Server, func(e NodeEntry) string { return e.Server })
 }
 
 // IdentityFor returns the identity override for a node or the global default.
 func (c Config) IdentityFor(nodeID string) string {
-	if nodeID != "" && c.Nodes != nil {
-		if entry, ok := c.Nodes[nodeID]; ok && entry.Identity != "" {
-			return entry.Identity
+	return c.nodeValue(nodeID, c.Identity, func(e NodeEntry) string { return e.Identity })
+}
+
+// UserFor returns the login user for a node or the global default.
+func (c Config) UserFor(nodeID string) string {
+	return c.nodeValue(nodeID, c.User, func(e NodeEntry) string { return e.User })
+}
+
+// ServiceFor returns the agent service to reach for a node.
+func (c Config) ServiceFor(nodeID string) string {
+	return c.nodeValue(nodeID, "", func(e NodeEntry) string { return e.Service })
+}
+
+// CommandFor returns the default remote command for a node.
+func (c Config) CommandFor(nodeID string) string {
+	return c.nodeValue(nodeID, "", func(e NodeEntry) string { return e.Command })
+}
+
+// ResolveAlias returns the node-id whose entry declares name as its alias.
+func (c Config) ResolveAlias(name string) (string, bool) {
+	for nodeID, entry := range c.Nodes {
+		if entry.Alias == name && !IsPattern(nodeID) {
+			return nodeID, true
+		}
+	}
+	return "", false
+}
+
+// KnowsNode reports whether name is a configured node-id or alias.
+func (c Config) KnowsNode(name string) bool {
+	if _, ok := c.Nodes[name]; ok && !IsPattern(name) {
+		return true
+	}
+	_, ok := c.ResolveAlias(name)
+	return ok
+}
+
+// nodeValue returns the first non-empty value of field among the entries
+// matching nodeID, or fallback.
+func (c Config) nodeValue(nodeID, fallback string, field func(NodeEntry) string) string {
+	for _, entry := range c.matchingNodes(nodeID) {
+		if value := field(entry); value != "" {
+			return value
+		}
+	}
+	return fallback
+}
+
+// AuthFor returns the authentication method order for a node or the global default.
+func (c Config) AuthFor(nodeID string) []string {
+	for _, entry := range c.matchingNodes(nodeID) {
+		if len(entry.Auth) > 0 {
+			return entry.Auth
+		}
+	}
+	return c.Auth
+}
+
+// matchingNodes returns the node entries that apply to nodeID, most specific
+// first: an exact entry, then glob patterns (e.g. "prod-*", "*.eu") ordered
+// by NodePatterns. Each setting is taken from the first entry that sets it.
+func (c Config) matchingNodes(nodeID string) []NodeEntry {
+	if nodeID == "" || len(c.Nodes) == 0 {
+		return nil
+	}
+	var entries []NodeEntry
+	if entry, ok := c.Nodes[nodeID]; ok {
+		entries = append(entries, entry)
+	}
+	for _, pattern := range c.NodePatterns() {
+		if ok, _ := path.Match(pattern, nodeID); ok {
+			entries = append(entries, c.Nodes[pattern])
+		}
+	}
+	return entries
+}
+
+// NodePatterns returns the glob keys of Nodes from most to least specific.
+// Patterns with more literal characters win; ties are broken by fewer
+// wildcards and then alphabetically so the order is stable.
+func (c Config) NodePatterns() []string {
+	var patterns []string
+	for key := range c.Nodes {
+		if IsPattern(key) {
+			patterns = append(patterns, key)
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		li, wi := patternWeight(patterns[i])
+		lj, wj := patternWeight(patterns[j])
+		if li != lj {
+			return li > lj
+		}
+		if wi != wj {
+			return wi < wj
+		}
+		return patterns[i] < patterns[j]
+	})
+	return patterns
+}
+
+// IsPattern reports whether a node key contains glob metacharacters.
+func IsPattern(key string) bool {
+	return strings.ContainsAny(key, "*?[")
+}
+
+func patternWeight(pattern string) (literals, wildcards int) {
+	inClass := false
+	for _, r := range pattern {
+		switch {
+		case inClass:
+			if r == ']' {
+				inClass = false
+			}
+		case r == '[':
+			inClass = true
+			wildcards++
+		case r == '*' || r == '?':
+			wildcards++
+		default:
+			literals++
 		}
 	}
-	return c.Identity
+	return literals, wildcards
 }
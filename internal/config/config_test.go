@@ -0,0 +1,179 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useFiles points Load at a system and a user file in a temporary directory;
+// an empty content leaves that file missing.
+func useFiles(t *testing.T, system, user string) {
+	t.Helper()
+	dir := t.TempDir()
+	systemPath := filepath.Join(dir, "system.yaml")
+	userPath := filepath.Join(dir, "user.yaml")
+	for path, data := range map[string]string{systemPath: system, userPath: user} {
+		if data == "" {
+			continue
+		}
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := SystemPath
+	SystemPath = systemPath
+	t.Cleanup(func() { SystemPath = old })
+	t.Setenv("MSSH_CONFIG", userPath)
+}
+
+func TestLoad(t *testing.T) {
+	const system = `server: system:8443
+user: admin
+auth: [publickey]
+nodes:
+  web-1:
+    user: www
+    server: edge:8443
+profiles:
+  prod:
+    server: prod:8443
+`
+	tests := []struct {
+		name         string
+		system, user string
+		want         Config
+		// wantErr is a substring of the expected error.
+		wantErr string
+	}{
+		{
+			name:    "neither file",
+			wantErr: ErrNotFound.Error(),
+		},
+		{
+			name:   "system only",
+			system: system,
+			want: Config{
+				Server: "system:8443", User: "admin", Auth: []string{"publickey"},
+				Nodes:    map[string]NodeEntry{"web-1": {User: "www", Server: "edge:8443"}},
+				Profiles: map[string]Profile{"prod": {Server: "prod:8443"}},
+			},
+		},
+		{
+			name: "user only",
+			user: "server: user:8443\n",
+			want: Config{Server: "user:8443"},
+		},
+		{
+			name:   "user wins and node entries are replaced whole",
+			system: system,
+			user: `server: user:8443
+nodes:
+  web-1:
+    alias: web
+  db-1:
+    user: pg
+`,
+			want: Config{
+				Server: "user:8443", User: "admin", Auth: []string{"publickey"},
+				Nodes: map[string]NodeEntry{
+					"web-1": {Alias: "web"},
+					"db-1":  {User: "pg"},
+				},
+				Profiles: map[string]Profile{"prod": {Server: "prod:8443"}},
+			},
+		},
+		{
+			name:    "invalid user file",
+			system:  system,
+			user:    "server: [\n",
+			wantErr: "user.yaml",
+		},
+		{
+			name:    "alias clash across files",
+			system:  "nodes:\n  a:\n    alias: x\n",
+			user:    "nodes:\n  b:\n    alias: x\n",
+			wantErr: `alias "x"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFiles(t, tt.system, tt.user)
+			got, err := Load()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want an error mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Load() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodePatterns(t *testing.T) {
+	cfg := Config{Nodes: map[string]NodeEntry{
+		"*":          {User: "any"},
+		"prod-*":     {User: "prod"},
+		"prod-db-*":  {User: "db", Identity: "db_key"},
+		"prod-db-?":  {Server: "short:1"},
+		"*.eu":       {Server: "eu:1"},
+		"prod-[ab]*": {},
+		"web-1":      {User: "exact"},
+	}}
+	// Ties on literals go to fewer wildcards, then alphabetical order.
+	want := []string{"prod-db-*", "prod-db-?", "prod-*", "prod-[ab]*", "*.eu", "*"}
+	if got := cfg.NodePatterns(); !reflect.DeepEqual(got, want) {
+		t.Errorf("NodePatterns() = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		nodeID, user, server, identity string
+	}{
+		{"web-1", "exact", "", ""},
+		{"prod-db-1", "db", "short:1", "db_key"},
+		{"prod-db-10", "db", "", "db_key"},
+		{"prod-web", "prod", "", ""},
+		{"cache.eu", "any", "eu:1", ""},
+	}
+	for _, tt := range tests {
+		if got := cfg.UserFor(tt.nodeID); got != tt.user {
+			t.Errorf("UserFor(%q) = %q, want %q", tt.nodeID, got, tt.user)
+		}
+		if got := cfg.ServerFor(tt.nodeID); got != tt.server {
+			t.Errorf("ServerFor(%q) = %q, want %q", tt.nodeID, got, tt.server)
+		}
+		if got := cfg.IdentityFor(tt.nodeID); got != tt.identity {
+			t.Errorf("IdentityFor(%q) = %q, want %q", tt.nodeID, got, tt.identity)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		nodes   map[string]NodeEntry
+		wantErr bool
+	}{
+		{"distinct aliases", map[string]NodeEntry{"a": {Alias: "x"}, "b": {Alias: "y"}}, false},
+		{"alias equal to own id", map[string]NodeEntry{"a": {Alias: "a"}}, false},
+		{"pattern aliases are ignored", map[string]NodeEntry{"a": {Alias: "x"}, "prod-*": {Alias: "x"}}, false},
+		{"shared alias", map[string]NodeEntry{"a": {Alias: "x"}, "b": {Alias: "x"}}, true},
+		{"alias shadows a node-id", map[string]NodeEntry{"a": {Alias: "b"}, "b": {}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Config{Nodes: tt.nodes}.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,438 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrUnknownKey is returned for keys that do not name a config setting.
+var ErrUnknownKey = errors.New("unknown config key")
+
+// Setting is a single key/value pair as shown by 'mssh config list'.
+type Setting struct {
+	Key   string
+	Value string
+	// Secret marks credentials that should not be printed unless asked for
+	// by name.
+	Secret bool
+}
+
+type globalField struct {
+	get    func(*Config) string
+	set    func(*Config, string)
+	secret bool
+}
+
+type nodeField struct {
+	get func(*NodeEntry) string
+	set func(*NodeEntry, string)
+}
+
+type profileField struct {
+	get    func(*Profile) string
+	set    func(*Profile, string)
+	secret bool
+}
+
+type tlsField struct {
+	get func(*TLSConfig) string
+	set func(*TLSConfig, string)
+}
+
+// globalFields, nodeFields and profileFields map dotted config keys to struct
+// fields. List values are represented as comma-separated strings and booleans
+// as "true" or empty.
+var globalFields = map[string]globalField{
+	"server": {
+		get: func(c *Config) string { return c.Server },
+		set: func(c *Config, v string) { c.Server = v },
+	},
+	"identity": {
+		get: func(c *Config) string { return c.Identity },
+		set: func(c *Config, v string) { c.Identity = v },
+	},
+	"user": {
+		get: func(c *Config) string { return c.User },
+		set: func(c *Config, v string) { c.User = v },
+	},
+	"auth": {
+		get: func(c *Config) string { return joinList(c.Auth) },
+		set: func(c *Config, v string) { c.Auth = SplitList(v) },
+	},
+	"cert-authorities": {
+		get: func(c *Config) string { return joinList(c.CertAuthorities) },
+		set: func(c *Config, v string) { c.CertAuthorities = SplitList(v) },
+	},
+	"token": {
+		get:    func(c *Config) string { return c.Token },
+		set:    func(c *Config, v string) { c.Token = v },
+		secret: true,
+	},
+	"profile": {
+		get: func(c *Config) string { return c.Profile },
+		set: func(c *Config, v string) { c.Profile = v },
+	},
+	"agent.node-id": {
+		get: func(c *Config) string { return c.Agent.NodeID },
+		set: func(c *Config, v string) { c.Agent.NodeID = v },
+	},
+	"agent.server": {
+		get: func(c *Config) string { return c.Agent.Server },
+		set: func(c *Config, v string) { c.Agent.Server = v },
+	},
+	"agent.ssh-port": {
+		get: func(c *Config) string { return formatInt(c.Agent.SSHPort) },
+		set: func(c *Config, v string) { c.Agent.SSHPort = parseInt(v) },
+	},
+	"agent.service": {
+		get: func(c *Config) string { return c.Agent.Service },
+		set: func(c *Config, v string) { c.Agent.Service = v },
+	},
+	"agent.allow": {
+		get: func(c *Config) string { return joinList(c.Agent.Allow) },
+		set: func(c *Config, v string) { c.Agent.Allow = SplitList(v) },
+	},
+	"agent.tags": {
+		get: func(c *Config) string { return joinTags(c.Agent.Tags) },
+		set: func(c *Config, v string) { c.Agent.Tags = splitTags(v) },
+	},
+}
+
+var nodeFields = map[string]nodeField{
+	"server": {
+		get: func(n *NodeEntry) string { return n.Server },
+		set: func(n *NodeEntry, v string) { n.Server = v },
+	},
+	"identity": {
+		get: func(n *NodeEntry) string { return n.Identity },
+		set: func(n *NodeEntry, v string) { n.Identity = v },
+	},
+	"auth": {
+		get: func(n *NodeEntry) string { return joinList(n.Auth) },
+		set: func(n *NodeEntry, v string) { n.Auth = SplitList(v) },
+	},
+	"user": {
+		get: func(n *NodeEntry) string { return n.User },
+		set: func(n *NodeEntry, v string) { n.User = v },
+	},
+	"alias": {
+		get: func(n *NodeEntry) string { return n.Alias },
+		set: func(n *NodeEntry, v string) { n.Alias = v },
+	},
+	"service": {
+		get: func(n *NodeEntry) string { return n.Service },
+		set: func(n *NodeEntry, v string) { n.Service = v },
+	},
+	"command": {
+		get: func(n *NodeEntry) string { return n.Command },
+		set: func(n *NodeEntry, v string) { n.Command = v },
+	},
+}
+
+var profileFields = map[string]profileField{
+	"server": {
+		get: func(p *Profile) string { return p.Server },
+		set: func(p *Profile, v string) { p.Server = v },
+	},
+	"identity": {
+		get: func(p *Profile) string { return p.Identity },
+		set: func(p *Profile, v string) { p.Identity = v },
+	},
+	"auth": {
+		get: func(p *Profile) string { return joinList(p.Auth) },
+		set: func(p *Profile, v string) { p.Auth = SplitList(v) },
+	},
+	"token": {
+		get:    func(p *Profile) string { return p.Token },
+		set:    func(p *Profile, v string) { p.Token = v },
+		secret: true,
+	},
+}
+
+// tlsFields are available both globally and per profile.
+var tlsFields = map[string]tlsField{
+	"tls": {
+		get: func(t *TLSConfig) string { return formatBool(t.Enabled) },
+		set: func(t *TLSConfig, v string) { t.Enabled = parseBool(v) },
+	},
+	"tls-ca": {
+		get: func(t *TLSConfig) string { return t.CA },
+		set: func(t *TLSConfig, v string) { t.CA = v },
+	},
+	"tls-cert": {
+		get: func(t *TLSConfig) string { return t.Cert },
+		set: func(t *TLSConfig, v string) { t.Cert = v },
+	},
+	"tls-key": {
+		get: func(t *TLSConfig) string { return t.Key },
+		set: func(t *TLSConfig, v string) { t.Key = v },
+	},
+	"tls-server-name": {
+		get: func(t *TLSConfig) string { return t.ServerName },
+		set: func(t *TLSConfig, v string) { t.ServerName = v },
+	},
+	"tls-insecure": {
+		get: func(t *TLSConfig) string { return formatBool(t.InsecureSkipVerify) },
+		set: func(t *TLSConfig, v string) { t.InsecureSkipVerify = parseBool(v) },
+	},
+}
+
+func init() {
+	for name, f := range tlsFields {
+		globalFields[name] = globalField{
+			get: func(c *Config) string { return f.get(&c.TLS) },
+			set: func(c *Config, v string) { f.set(&c.TLS, v) },
+		}
+		profileFields[name] = profileField{
+			get: func(p *Profile) string { return f.get(&p.TLS) },
+			set: func(p *Profile, v string) { f.set(&p.TLS, v) },
+		}
+	}
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "true"
+	}
+	return ""
+}
+
+func formatInt(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// parseInt and parseBool treat unparsable values as zero; values are
+// validated before they are set.
+func parseInt(v string) int {
+	n, _ := strconv.Atoi(v)
+	return n
+}
+
+func parseBool(v string) bool {
+	b, _ := strconv.ParseBool(v)
+	return b
+}
+
+// SplitList parses a comma-separated list value, dropping empty items.
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func joinList(items []string) string {
+	return strings.Join(items, ",")
+}
+
+// joinTags formats tags as comma-separated key=value pairs sorted by key.
+func joinTags(tags map[string]string) string {
+	items := make([]string, 0, len(tags))
+	for key, value := range tags {
+		items = append(items, key+"="+value)
+	}
+	sort.Strings(items)
+	return joinList(items)
+}
+
+func splitTags(value string) map[string]string {
+	items := SplitList(value)
+	if len(items) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(items))
+	for _, item := range items {
+		key, val, _ := strings.Cut(item, "=")
+		tags[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return tags
+}
+
+// Key is a parsed config key. At most one of Node and Profile is set.
+type Key struct {
+	Node    string
+	Profile string
+	Field   string
+}
+
+// ParseKey splits a config key into its scope and field name. Node keys have
+// the form nodes.<node-id>.<field> and profile keys profiles.<name>.<field>;
+// node-ids may contain dots.
+func ParseKey(key string) (Key, error) {
+	if rest, ok := strings.CutPrefix(key, "nodes."); ok {
+		idx := strings.LastIndex(rest, ".")
+		if idx <= 0 {
+			return Key{}, fmt.Errorf("%w: %s (expected nodes.<node-id>.<field>)", ErrUnknownKey, key)
+		}
+		k := Key{Node: rest[:idx], Field: rest[idx+1:]}
+		if _, ok := nodeFields[k.Field]; !ok {
+			return Key{}, fmt.Errorf("%w: %s", ErrUnknownKey, key)
+		}
+		return k, nil
+	}
+	if rest, ok := strings.CutPrefix(key, "profiles."); ok {
+		name, field, ok := strings.Cut(rest, ".")
+		if !ok || name == "" {
+			return Key{}, fmt.Errorf("%w: %s (expected profiles.<name>.<field>)", ErrUnknownKey, key)
+		}
+		if _, ok := profileFields[field]; !ok {
+			return Key{}, fmt.Errorf("%w: %s", ErrUnknownKey, key)
+		}
+		return Key{Profile: name, Field: field}, nil
+	}
+	if _, ok := globalFields[key]; !ok {
+		return Key{}, fmt.Errorf("%w: %s", ErrUnknownKey, key)
+	}
+	return Key{Field: key}, nil
+}
+
+// Get returns the value stored under key; an empty string means unset.
+func (c Config) Get(key string) (string, error) {
+	k, err := ParseKey(key)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case k.Node != "":
+		entry := c.Nodes[k.Node]
+		return nodeFields[k.Field].get(&entry), nil
+	case k.Profile != "":
+		profile := c.Profiles[k.Profile]
+		return profileFields[k.Field].get(&profile), nil
+	}
+	return globalFields[k.Field].get(&c), nil
+}
+
+// Set stores value under key. Callers are expected to validate the value.
+func (c *Config) Set(key, value string) error {
+	k, err := ParseKey(key)
+	if err != nil {
+		return err
+	}
+	switch {
+	case k.Node != "":
+		if c.Nodes == nil {
+			c.Nodes = make(map[string]NodeEntry)
+		}
+		entry := c.Nodes[k.Node]
+		nodeFields[k.Field].set(&entry, value)
+		c.Nodes[k.Node] = entry
+		c.pruneNode(k.Node)
+	case k.Profile != "":
+		if c.Profiles == nil {
+			c.Profiles = make(map[string]Profile)
+		}
+		profile := c.Profiles[k.Profile]
+		profileFields[k.Field].set(&profile, value)
+		c.Profiles[k.Profile] = profile
+		c.pruneProfile(k.Profile)
+	default:
+		globalFields[k.Field].set(c, value)
+	}
+	return nil
+}
+
+// Unset clears key. "nodes.<node-id>" removes every override for that node
+// and "profiles.<name>" removes the whole profile.
+func (c *Config) Unset(key string) error {
+	if nodeID, ok := strings.CutPrefix(key, "nodes."); ok {
+		if _, exists := c.Nodes[nodeID]; exists {
+			delete(c.Nodes, nodeID)
+			c.pruneNode(nodeID)
+			return nil
+		}
+		if _, err := ParseKey(key); err != nil {
+			// An unknown field of an existing node is still an unknown key.
+			if idx := strings.LastIndex(nodeID, "."); idx > 0 {
+				if _, exists := c.Nodes[nodeID[:idx]]; exists {
+					return err
+				}
+			}
+			return fmt.Errorf("no such node: %s", nodeID)
+		}
+	}
+	if name, ok := strings.CutPrefix(key, "profiles."); ok {
+		if _, exists := c.Profiles[name]; exists {
+			delete(c.Profiles, name)
+			c.pruneProfile(name)
+			return nil
+		}
+		if !strings.Contains(name, ".") {
+			return fmt.Errorf("no such profile: %s", name)
+		}
+	}
+	return c.Set(key, "")
+}
+
+// pruneNode drops empty node entries so they are not written back to disk.
+func (c *Config) pruneNode(nodeID string) {
+	if entry, ok := c.Nodes[nodeID]; ok {
+		empty := true
+		for _, f := range nodeFields {
+			if f.get(&entry) != "" {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			delete(c.Nodes, nodeID)
+		}
+	}
+	if len(c.Nodes) == 0 {
+		c.Nodes = nil
+	}
+}
+
+// pruneProfile is the profile counterpart of pruneNode.
+func (c *Config) pruneProfile(name string) {
+	if profile, ok := c.Profiles[name]; ok {
+		empty := true
+		for _, f := range profileFields {
+			if f.get(&profile) != "" {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			delete(c.Profiles, name)
+		}
+	}
+	if len(c.Profiles) == 0 {
+		c.Profiles = nil
+	}
+}
+
+// Settings returns every non-empty setting sorted by key.
+func (c Config) Settings() []Setting {
+	var settings []Setting
+	for key, f := range globalFields {
+		if value := f.get(&c); value != "" {
+			settings = append(settings, Setting{Key: key, Value: value, Secret: f.secret})
+		}
+	}
+	for nodeID, entry := range c.Nodes {
+		for name, f := range nodeFields {
+			if value := f.get(&entry); value != "" {
+				settings = append(settings, Setting{Key: "nodes." + nodeID + "." + name, Value: value})
+			}
+		}
+	}
+	for profileName, profile := range c.Profiles {
+		for name, f := range profileFields {
+			if value := f.get(&profile); value != "" {
+				settings = append(settings, Setting{Key: "profiles." + profileName + "." + name, Value: value, Secret: f.secret})
+			}
+		}
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Key < settings[j].Key })
+	return settings
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		key     string
+		want    Key
+		wantErr bool
+	}{
+		{"server", Key{Field: "server"}, false},
+		{"agent.ssh-port", Key{Field: "agent.ssh-port"}, false},
+		{"tls-ca", Key{Field: "tls-ca"}, false},
+		{"nodes.web-1.server", Key{Node: "web-1", Field: "server"}, false},
+		{"nodes.db.prod.eu.alias", Key{Node: "db.prod.eu", Field: "alias"}, false},
+		{"nodes.prod-*.user", Key{Node: "prod-*", Field: "user"}, false},
+		{"profiles.prod.token", Key{Profile: "prod", Field: "token"}, false},
+		{"profiles.prod.tls-insecure", Key{Profile: "prod", Field: "tls-insecure"}, false},
+		{"nope", Key{}, true},
+		{"nodes.web-1", Key{}, true},
+		{"nodes..server", Key{}, true},
+		{"nodes.web-1.token", Key{}, true},
+		{"profiles.prod", Key{}, true},
+		{"profiles..server", Key{}, true},
+		{"profiles.prod.user", Key{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got, err := ParseKey(tt.key)
+			if tt.wantErr {
+				if !errors.Is(err, ErrUnknownKey) {
+					t.Fatalf("ParseKey(%q) = %+v, %v; want ErrUnknownKey", tt.key, got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("ParseKey(%q) = %+v, %v; want %+v", tt.key, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetGet(t *testing.T) {
+	tests := []struct {
+		key, value string
+		check      func(Config) bool
+	}{
+		{"server", "rv:8443", func(c Config) bool { return c.Server == "rv:8443" }},
+		{"auth", "password, publickey,", func(c Config) bool { return reflect.DeepEqual(c.Auth, []string{"password", "publickey"}) }},
+		{"agent.ssh-port", "2222", func(c Config) bool { return c.Agent.SSHPort == 2222 }},
+		{"agent.tags", "role=db, env=prod", func(c Config) bool {
+			return reflect.DeepEqual(c.Agent.Tags, map[string]string{"role": "db", "env": "prod"})
+		}},
+		{"tls-insecure", "true", func(c Config) bool { return c.TLS.InsecureSkipVerify }},
+		{"nodes.web-1.alias", "web", func(c Config) bool { return c.Nodes["web-1"].Alias == "web" }},
+		{"profiles.prod.tls-ca", "/ca.pem", func(c Config) bool { return c.Profiles["prod"].TLS.CA == "/ca.pem" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			var cfg Config
+			if err := cfg.Set(tt.key, tt.value); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("Set(%q, %q) gave %+v", tt.key, tt.value, cfg)
+			}
+			got, err := cfg.Get(tt.key)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			// Get returns the normalized form, which must round-trip.
+			var again Config
+			if err := again.Set(tt.key, got); err != nil || !reflect.DeepEqual(again, cfg) {
+				t.Errorf("Get(%q) = %q does not round-trip: %+v", tt.key, got, again)
+			}
+		})
+	}
+}
+
+func TestUnset(t *testing.T) {
+	base := func() Config {
+		return Config{
+			Server: "rv:8443",
+			Nodes: map[string]NodeEntry{
+				"web-1":  {Server: "a:1", User: "alice"},
+				"db.eu":  {Alias: "db"},
+				"prod-*": {User: "ops"},
+			},
+			Profiles: map[string]Profile{
+				"prod":    {Server: "p:1", Token: "t"},
+				"staging": {Token: "s"},
+			},
+		}
+	}
+	tests := []struct {
+		name    string
+		key     string
+		want    func(*Config)
+		wantErr bool
+	}{
+		{"global", "server", func(c *Config) { c.Server = "" }, false},
+		{"node field", "nodes.web-1.user", func(c *Config) { c.Nodes["web-1"] = NodeEntry{Server: "a:1"} }, false},
+		{"last node field prunes node", "nodes.db.eu.alias", func(c *Config) { delete(c.Nodes, "db.eu") }, false},
+		{"whole node", "nodes.web-1", func(c *Config) { delete(c.Nodes, "web-1") }, false},
+		{"node with dots", "nodes.db.eu", func(c *Config) { delete(c.Nodes, "db.eu") }, false},
+		{"pattern node", "nodes.prod-*", func(c *Config) { delete(c.Nodes, "prod-*") }, false},
+		{"last profile field prunes profile", "profiles.staging.token", func(c *Config) { delete(c.Profiles, "staging") }, false},
+		{"whole profile", "profiles.prod", func(c *Config) { delete(c.Profiles, "prod") }, false},
+		{"unknown node", "nodes.nope", nil, true},
+		{"unknown field of a node", "nodes.web-1.bogus", nil, true},
+		{"unknown profile", "profiles.nope", nil, true},
+		{"unknown key", "bogus", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base()
+			err := cfg.Unset(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unset(%q): err = %v, wantErr %v", tt.key, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			want := base()
+			tt.want(&want)
+			if !reflect.DeepEqual(cfg, want) {
+				t.Errorf("Unset(%q) = %+v, want %+v", tt.key, cfg, want)
+			}
+		})
+	}
+}
+
+func TestPruneDropsEmptyMaps(t *testing.T) {
+	cfg := Config{}
+	if err := cfg.Set("nodes.web-1.user", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Set("profiles.prod.server", "p:1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"nodes.web-1.user", "profiles.prod.server"} {
+		if err := cfg.Unset(key); err != nil {
+			t.Fatalf("Unset(%q): %v", key, err)
+		}
+	}
+	// Empty maps would be written back as "nodes: {}".
+	if cfg.Nodes != nil || cfg.Profiles != nil {
+		t.Errorf("nodes = %#v, profiles = %#v, want nil", cfg.Nodes, cfg.Profiles)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	cfg := Config{
+		Server: "rv:8443",
+		Token:  "s3cret",
+		TLS:    TLSConfig{CA: "/ca.pem"},
+		Nodes:  map[string]NodeEntry{"web-1": {User: "alice"}},
+		Profiles: map[string]Profile{
+			"prod": {Token: "p", Identity: "~/.ssh/prod"},
+		},
+	}
+	want := []Setting{
+		{Key: "nodes.web-1.user", Value: "alice"},
+		{Key: "profiles.prod.identity", Value: "~/.ssh/prod"},
+		{Key: "profiles.prod.token", Value: "p", Secret: true},
+		{Key: "server", Value: "rv:8443"},
+		{Key: "tls-ca", Value: "/ca.pem"},
+		{Key: "token", Value: "s3cret", Secret: true},
+	}
+	if got := cfg.Settings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Settings() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,82 @@
+// Package logging configures the structured logger shared by every command.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Attribute keys used consistently across server, agent and client logs.
+const (
+	KeyComponent  = "component"
+	KeyNodeID     = "node_id"
+	KeyService    = "service"
+	KeyRemoteAddr = "remote_addr"
+	KeySessionID  = "session_id"
+	KeyServer     = "server"
+	KeyError      = "error"
+)
+
+// Formats accepted by Setup.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var out = &switchWriter{w: os.Stderr}
+
+// Setup installs the default slog logger with the given format ("text" or
+// "json") and level ("debug", "info", "warn" or "error"). Output from the
+// standard log package is routed through it as well.
+func Setup(format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case FormatText:
+		handler = slog.NewTextHandler(out, opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("invalid log format %q (want %s or %s)", format, FormatText, FormatJSON)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// SetOutput redirects log output, for example to a file reopened on reload.
+// Loggers created earlier follow the switch.
+func SetOutput(w io.Writer) {
+	out.mu.Lock()
+	out.w = w
+	out.mu.Unlock()
+}
+
+// Component returns the default logger tagged with a component name.
+func Component(name string) *slog.Logger {
+	return slog.Default().With(KeyComponent, name)
+}
+
+// Err formats err as an attribute under KeyError.
+func Err(err error) slog.Attr {
+	return slog.Any(KeyError, err)
+}
+
+// switchWriter serializes writes to a destination that can be swapped.
+type switchWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
@@ -0,0 +1,18 @@
+package protocol
+
+// Control channel messages (v2 only). An agent whose AGENT handshake gets
+// CapControl back keeps the connection as a control channel: the server
+// sends a PAIR message for every client, and the agent answers by opening a
+// new connection with a DATA header for that session, or by sending REFUSE
+// on the control channel. Each DATA connection then carries one session.
+const (
+	TypeData   = "DATA"
+	TypeRefuse = "REFUSE"
+)
+
+// CapControl asks the server to keep the registration as a control channel
+// instead of pairing it with a single client.
+const CapControl = "control"
+
+// FieldReason explains a REFUSE message.
+const FieldReason = "reason"
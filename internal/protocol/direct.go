@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"net"
+	"strings"
+)
+
+// Direct connections (v2 only). The server marks the PAIR message with
+// CapDirect when the client asked for a direct connection; only then does a
+// control agent prepare one. A client and a control agent that both send
+// CapDirect advertise the addresses they can be reached on in FieldAddrs.
+// The server adds the address it observed for each side and passes them to
+// the other in FieldPeerAddrs, with CapDirect in both OK replies. The
+// client then tries to reach the agent directly and sends DirectChosen or
+// RelayChosen as the first line through the relay, so both sides switch or
+// stay together.
+const CapDirect = "direct"
+
+// Address fields for direct connections; values are FormatAddrs lists.
+const (
+	FieldAddrs     = "addrs"
+	FieldPeerAddrs = "peer-addrs"
+)
+
+// Path decisions sent by the client through the relay.
+const (
+	DirectChosen = "direct"
+	RelayChosen  = "relay"
+)
+
+// FormatAddrs joins host:port addresses for FieldAddrs.
+func FormatAddrs(addrs []string) string {
+	return strings.Join(addrs, ",")
+}
+
+// ParseAddrs splits a FormatAddrs list, dropping entries that are not
+// host:port.
+func ParseAddrs(value string) []string {
+	var addrs []string
+	for _, addr := range splitList(value) {
+		if _, _, err := net.SplitHostPort(addr); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
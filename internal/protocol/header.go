@@ -0,0 +1,273 @@
+// Package protocol defines the rendezvous handshake.
+//
+// Version 1 is a single header line:
+//
+//	TYPE NODE-ID [key=value ...]
+//
+// where TYPE is AGENT or CLIENT. LIST takes no node-id. The server answers
+// with "OK [key=value ...]" or "ERROR: <reason>".
+//
+// Version 2 (see version.go) carries the same header as a block of
+// "key: value" lines, so values may contain spaces, and negotiates
+// capabilities explicitly:
+//
+//	MSSH/2 AGENT
+//	node-id: web-1
+//	capabilities: pair, confirm
+//
+// An agent with the pair capability (notify=pair in v1) that gets it back
+// in the OK receives a PAIR message once a client is paired with it; only
+// then does it connect to its local sshd. Servers that predate header fields
+// reject the request with "ERROR: invalid header"; Negotiate then registers
+// with a bare "AGENT node-id" line and the agent runs without pair. With
+// confirm (confirm=1 in v1) the PAIR message
+// carries the client identity and the agent answers with OK or ERROR before
+// any client bytes flow.
+//
+// With the control capability (v2 only, see control.go) the registration
+// stays open and the agent dials a fresh connection for each session.
+//
+// Every paired client gets a session ID, returned in its OK as session=<id>
+// and sent to the agent in the PAIR message, so the three sides can
+// correlate their logs.
+package protocol
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Header types.
+const (
+	TypeAgent  = "AGENT"
+	TypeClient = "CLIENT"
+	TypeList   = "LIST"
+	// TypePair is sent by the server to agents with the pair capability.
+	TypePair = "PAIR"
+)
+
+// Optional header fields.
+const (
+	FieldService = "service"
+	FieldToken   = "token"
+	FieldNotify  = "notify"
+	FieldConfirm = "confirm"
+	FieldSession = "session"
+	// FieldWait asks the server to hold a CLIENT for up to this many seconds
+	// until the agent registers, instead of failing with "agent offline".
+	FieldWait = "wait"
+)
+
+// Client identity fields sent to confirming agents in the PAIR line. Values
+// are escaped with EscapeValue.
+const (
+	FieldClientToken       = "client-token"
+	FieldClientSubject     = "client-subject"
+	FieldClientFingerprint = "client-fingerprint"
+)
+
+// NotifyPair is the FieldNotify value requesting a PAIR line on pairing.
+const NotifyPair = "pair"
+
+// Capabilities. In v1 the first two travel as notify=pair and confirm=1.
+const (
+	// CapPair asks for a PAIR message before client bytes flow.
+	CapPair = "pair"
+	// CapConfirm has the PAIR message carry the client identity for the
+	// agent to accept or refuse.
+	CapConfirm = "confirm"
+)
+
+// NamePattern matches valid node-ids and service names.
+var NamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Header is a parsed handshake message.
+type Header struct {
+	// Version is the protocol version the header was read or will be sent
+	// in; zero means Version1.
+	Version int
+	Type    string
+	NodeID  string
+	Fields  map[string]string
+	Caps    []string
+}
+
+// String formats the header as a v1 line without the trailing newline.
+// Empty fields are omitted and the rest are sorted so the output is stable.
+func (h Header) String() string {
+	parts := []string{h.Type}
+	if h.NodeID != "" {
+		parts = append(parts, h.NodeID)
+	}
+	fields := legacyFields(h.Fields, h.Caps)
+	for _, key := range sortedKeys(fields) {
+		parts = append(parts, key+"="+fields[key])
+	}
+	return strings.Join(parts, " ")
+}
+
+// Field returns the value of an optional field.
+func (h Header) Field(key string) string {
+	return h.Fields[key]
+}
+
+// Has reports whether the header offers capability c.
+func (h Header) Has(c string) bool {
+	return hasCap(h.Caps, c)
+}
+
+// ParseHeader parses a handshake line. Unknown fields are kept so newer
+// peers can talk to older servers, which simply ignore them.
+func ParseHeader(line string) (Header, error) {
+	parts := strings.Fields(strings.TrimSpace(line))
+	if len(parts) == 0 {
+		return Header{}, fmt.Errorf("empty header")
+	}
+
+	h := Header{Type: strings.ToUpper(parts[0])}
+	rest := parts[1:]
+	if h.Type != TypeList && h.Type != TypePair {
+		if len(rest) == 0 {
+			return Header{}, fmt.Errorf("missing node-id")
+		}
+		h.NodeID, rest = rest[0], rest[1:]
+	}
+
+	fields, err := parseFields(rest)
+	if err != nil {
+		return Header{}, err
+	}
+	h.Version = Version1
+	h.Fields = fields
+	h.Caps = legacyCaps(fields)
+	return h, nil
+}
+
+// legacyFields returns fields with caps expressed as v1 fields.
+func legacyFields(fields map[string]string, caps []string) map[string]string {
+	if len(caps) == 0 {
+		return fields
+	}
+	out := make(map[string]string, len(fields)+2)
+	for key, value := range fields {
+		out[key] = value
+	}
+	if hasCap(caps, CapPair) {
+		out[FieldNotify] = NotifyPair
+	}
+	if hasCap(caps, CapConfirm) {
+		out[FieldConfirm] = "1"
+	}
+	return out
+}
+
+// legacyCaps reads the capabilities expressed as v1 fields.
+func legacyCaps(fields map[string]string) []string {
+	var caps []string
+	if fields[FieldNotify] == NotifyPair {
+		caps = append(caps, CapPair)
+	}
+	if fields[FieldConfirm] == "1" {
+		caps = append(caps, CapConfirm)
+	}
+	return caps
+}
+
+func hasCap(caps []string, c string) bool {
+	for _, have := range caps {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of fields with non-empty values, sorted.
+func sortedKeys(fields map[string]string) []string {
+	keys := make([]string, 0, len(fields))
+	for key, value := range fields {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func parseFields(parts []string) (map[string]string, error) {
+	fields := make(map[string]string, len(parts))
+	for _, part := range parts {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("malformed field %q", part)
+		}
+		fields[strings.ToLower(key)] = value
+	}
+	return fields, nil
+}
+
+// EscapeValue encodes a field value that may contain spaces or '='.
+func EscapeValue(value string) string {
+	return url.QueryEscape(value)
+}
+
+// UnescapeValue reverses EscapeValue; invalid input is returned unchanged.
+func UnescapeValue(value string) string {
+	if decoded, err := url.QueryUnescape(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// Reply is a parsed server response.
+type Reply struct {
+	Version int
+	Fields  map[string]string
+	// Caps are the capabilities the server accepted.
+	Caps []string
+}
+
+// OK formats a successful v1 reply carrying fields.
+func OK(fields map[string]string) string {
+	return Header{Type: "OK", Fields: fields}.String()
+}
+
+// RemoteError is an ERROR reply from the peer.
+type RemoteError struct {
+	Reason string
+}
+
+func (e *RemoteError) Error() string {
+	return "ERROR: " + e.Reason
+}
+
+// ParseReply parses an "OK [key=value ...]" line. "ERROR: <reason>" is
+// returned as a *RemoteError, anything else as a plain error.
+func ParseReply(line string) (Reply, error) {
+	line = strings.TrimSpace(line)
+	if reason, ok := strings.CutPrefix(line, "ERROR:"); ok {
+		return Reply{}, &RemoteError{Reason: strings.TrimSpace(reason)}
+	}
+	parts := strings.Fields(line)
+	if len(parts) == 0 || parts[0] != "OK" {
+		return Reply{}, fmt.Errorf("unexpected server response %q", line)
+	}
+	fields, err := parseFields(parts[1:])
+	if err != nil {
+		return Reply{}, err
+	}
+	return Reply{Version: Version1, Fields: fields, Caps: legacyCaps(fields)}, nil
+}
+
+// Field returns the value of a reply field.
+func (r Reply) Field(key string) string {
+	return r.Fields[key]
+}
+
+// Has reports whether the server accepted capability c.
+func (r Reply) Has(c string) bool {
+	return hasCap(r.Caps, c)
+}
@@ -0,0 +1,215 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		header Header
+	}{
+		{"v1 client", Header{Version: Version1, Type: TypeClient, NodeID: "web-1", Fields: map[string]string{FieldToken: "s3cret"}}},
+		{"v1 agent with caps", Header{Version: Version1, Type: TypeAgent, NodeID: "db.prod", Fields: map[string]string{FieldService: "pg"}, Caps: []string{CapPair, CapConfirm}}},
+		{"v1 list", Header{Version: Version1, Type: TypeList, Fields: map[string]string{FieldToken: "t"}}},
+		{"v2 agent", Header{Version: Version2, Type: TypeAgent, NodeID: "web-1", Fields: map[string]string{FieldToken: "t", "hostname": "web 1"}, Caps: []string{CapPair, CapConfirm, CapControl}}},
+		{"v2 list", Header{Version: Version2, Type: TypeList, Fields: map[string]string{}, Caps: []string{CapMeta}}},
+		{"v2 pair", Header{Version: Version2, Type: TypePair, Fields: map[string]string{FieldSession: "abc"}}},
+		{"v2 pair direct", Header{Version: Version2, Type: TypePair, Fields: map[string]string{FieldSession: "abc"}, Caps: []string{CapDirect}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadHeader(bufio.NewReader(strings.NewReader(tt.header.Encode())))
+			if err != nil {
+				t.Fatalf("ReadHeader: %v", err)
+			}
+			want := tt.header
+			if want.Version == Version1 {
+				// v1 carries the pair and confirm capabilities as fields.
+				want.Fields = legacyFields(want.Fields, want.Caps)
+			}
+			if got.Version != want.Version || got.Type != want.Type || got.NodeID != want.NodeID {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+			if !reflect.DeepEqual(got.Fields, want.Fields) {
+				t.Errorf("fields = %v, want %v", got.Fields, want.Fields)
+			}
+			if !equalCaps(got.Caps, want.Caps) {
+				t.Errorf("caps = %v, want %v", got.Caps, want.Caps)
+			}
+		})
+	}
+}
+
+func TestReadHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		wantVersion int
+		wantErr     error
+	}{
+		{"empty line", "\n", 0, nil},
+		{"v1 missing node-id", "AGENT\n", 0, nil},
+		{"v1 malformed field", "CLIENT web-1 token\n", 0, nil},
+		{"v2 missing node-id", "MSSH/2 AGENT\ntoken: x\n\n", Version2, nil},
+		{"v2 missing type", "MSSH/2\nnode-id: web-1\n\n", Version2, nil},
+		{"v2 malformed line", "MSSH/2 CLIENT\nnode-id web-1\n\n", Version2, nil},
+		{"v2 empty key", "MSSH/2 CLIENT\n: web-1\n\n", Version2, nil},
+		{"v2 unterminated block", "MSSH/2 CLIENT\nnode-id: web-1\n", Version2, nil},
+		{"malformed version", "MSSH/x CLIENT\n\n", Version2, nil},
+		{"newer version", "MSSH/3 CLIENT\nnode-id: web-1\n\n", Version2, ErrUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ReadHeader(bufio.NewReader(strings.NewReader(tt.input)))
+			if err == nil {
+				t.Fatalf("ReadHeader(%q) = %+v, want error", tt.input, h)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if h.Version != tt.wantVersion {
+				t.Errorf("version = %d, want %d", h.Version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestReadBlock(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "\n", map[string]string{}, false},
+		{"fields", "Node-ID: web-1\r\nhostname:  web 1 \n\n", map[string]string{"node-id": "web-1", "hostname": "web 1"}, false},
+		{"value with colon", "addrs: 10.0.0.1:22\n\n", map[string]string{"addrs": "10.0.0.1:22"}, false},
+		{"no colon", "node-id\n\n", nil, true},
+		{"eof before end", "node-id: web-1\n", nil, true},
+		{"at the limit", strings.Repeat("k: v\n", maxBlockLines-1) + "\n", map[string]string{"k": "v"}, false},
+		{"over the limit", strings.Repeat("k: v\n", maxBlockLines) + "\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readBlock(bufio.NewReader(strings.NewReader(tt.input)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string
+		want       Reply
+		wantRemote string
+		wantErr    bool
+	}{
+		{"bare ok", "OK\n", Reply{Version: Version1, Fields: map[string]string{}}, "", false},
+		{"ok with session", "OK session=abc\n", Reply{Version: Version1, Fields: map[string]string{"session": "abc"}}, "", false},
+		{"ok with legacy caps", "OK confirm=1 notify=pair\n", Reply{Version: Version1, Fields: map[string]string{"confirm": "1", "notify": "pair"}, Caps: []string{CapPair, CapConfirm}}, "", false},
+		{"error", "ERROR: agent offline\n", Reply{}, "agent offline", false},
+		{"garbage", "HELLO\n", Reply{}, "", true},
+		{"empty", "\n", Reply{}, "", true},
+		{"malformed field", "OK session\n", Reply{}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseReply(tt.line)
+			var remote *RemoteError
+			switch {
+			case tt.wantRemote != "":
+				if !errors.As(err, &remote) || remote.Reason != tt.wantRemote {
+					t.Fatalf("err = %v, want remote error %q", err, tt.wantRemote)
+				}
+				return
+			case tt.wantErr:
+				if err == nil || errors.As(err, &remote) {
+					t.Fatalf("err = %v, want a local error", err)
+				}
+				return
+			case err != nil:
+				t.Fatalf("ParseReply: %v", err)
+			}
+			if got.Version != tt.want.Version || !reflect.DeepEqual(got.Fields, tt.want.Fields) || !equalCaps(got.Caps, tt.want.Caps) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplyRoundTrip(t *testing.T) {
+	tests := []Reply{
+		{Version: Version1, Fields: map[string]string{FieldSession: "abc"}, Caps: []string{CapPair}},
+		{Version: Version2, Fields: map[string]string{FieldSession: "abc"}, Caps: []string{CapPair, CapControl}},
+		{Version: Version2, Fields: map[string]string{}},
+	}
+	for _, want := range tests {
+		got, err := ReadReply(bufio.NewReader(strings.NewReader(want.Encode())))
+		if err != nil {
+			t.Fatalf("ReadReply(%q): %v", want.Encode(), err)
+		}
+		if got.Version != want.Version || got.Field(FieldSession) != want.Field(FieldSession) || !equalCaps(got.Caps, want.Caps) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+
+	for _, version := range []int{Version1, Version2} {
+		_, err := ReadReply(bufio.NewReader(strings.NewReader(ErrorReply(version, "too many sessions"))))
+		var remote *RemoteError
+		if !errors.As(err, &remote) || remote.Reason != "too many sessions" {
+			t.Errorf("v%d error reply: err = %v", version, err)
+		}
+	}
+}
+
+func TestLegacyMapping(t *testing.T) {
+	tests := []struct {
+		caps   []string
+		fields map[string]string
+	}{
+		{nil, map[string]string{}},
+		{[]string{CapPair}, map[string]string{FieldNotify: NotifyPair}},
+		{[]string{CapPair, CapConfirm}, map[string]string{FieldNotify: NotifyPair, FieldConfirm: "1"}},
+		// Capabilities without a v1 form are dropped.
+		{[]string{CapControl, CapMeta}, map[string]string{}},
+	}
+	for _, tt := range tests {
+		fields := legacyFields(map[string]string{}, tt.caps)
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("legacyFields(%v) = %v, want %v", tt.caps, fields, tt.fields)
+		}
+		var want []string
+		for _, c := range tt.caps {
+			if c == CapPair || c == CapConfirm {
+				want = append(want, c)
+			}
+		}
+		if caps := legacyCaps(fields); !equalCaps(caps, want) {
+			t.Errorf("legacyCaps(%v) = %v, want %v", fields, caps, want)
+		}
+	}
+
+	in := map[string]string{FieldToken: "t"}
+	legacyFields(in, []string{CapPair})
+	if len(in) != 1 {
+		t.Errorf("legacyFields modified its input: %v", in)
+	}
+}
+
+func equalCaps(a, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
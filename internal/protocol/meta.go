@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Metadata fields an agent reports at registration. Values are escaped with
+// EscapeValue.
+const (
+	FieldHostname = "hostname"
+	FieldOS       = "os"
+	FieldArch     = "arch"
+	FieldVersion  = "version"
+	// FieldIPs is a comma-separated list of the host's addresses.
+	FieldIPs = "ips"
+	// FieldUptime is the host uptime in seconds.
+	FieldUptime = "uptime"
+	// FieldTags holds user-defined tags as key=value pairs (see FormatTags).
+	FieldTags = "tags"
+)
+
+// MetaFields lists the metadata fields in display order.
+var MetaFields = []string{FieldHostname, FieldOS, FieldArch, FieldVersion, FieldIPs, FieldUptime, FieldTags}
+
+// CapMeta asks LIST to report each node's metadata on its line.
+const CapMeta = "meta"
+
+// ValidateTag checks one tag: the key must match NamePattern and the value
+// may not contain commas.
+func ValidateTag(key, value string) error {
+	if !NamePattern.MatchString(key) {
+		return fmt.Errorf("invalid tag key %q", key)
+	}
+	if strings.Contains(value, ",") {
+		return fmt.Errorf("tag %s: value may not contain commas", key)
+	}
+	return nil
+}
+
+// FormatTags encodes tags as "k=v,k=v" sorted by key.
+func FormatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key + "=" + tags[key]
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseTags decodes the output of FormatTags.
+func ParseTags(value string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, part := range splitList(value) {
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tag %q (expected key=value)", part)
+		}
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if err := ValidateTag(key, val); err != nil {
+			return nil, err
+		}
+		tags[key] = val
+	}
+	return tags, nil
+}
+
+// NodeLine formats one LIST entry: the node key followed by its metadata.
+func NodeLine(key string, meta map[string]string) string {
+	parts := []string{key}
+	for _, field := range sortedKeys(meta) {
+		parts = append(parts, field+"="+EscapeValue(meta[field]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseNodeLine parses a LIST entry written by NodeLine. Lines from servers
+// without metadata yield just the key.
+func ParseNodeLine(line string) (string, map[string]string, error) {
+	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return "", nil, fmt.Errorf("empty node line")
+	}
+	fields, err := parseFields(parts[1:])
+	if err != nil {
+		return "", nil, err
+	}
+	for key, value := range fields {
+		fields[key] = UnescapeValue(value)
+	}
+	return parts[0], fields, nil
+}
@@ -0,0 +1,291 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Protocol versions.
+const (
+	Version1 = 1
+	Version2 = 2
+)
+
+// versionPrefix starts the first line of every v2 or later message.
+const versionPrefix = "MSSH/"
+
+// Header keys with a fixed meaning in v2 blocks.
+const (
+	keyNodeID       = "node-id"
+	keyCapabilities = "capabilities"
+	keyReason       = "reason"
+)
+
+// maxBlockLines bounds the number of header lines a peer may send.
+const maxBlockLines = 64
+
+// ErrUnsupportedVersion is returned for a handshake in a version newer than
+// Version2.
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// LineReader is satisfied by bufio.Reader and stream.BufferedConn.
+type LineReader interface {
+	ReadString(delim byte) (string, error)
+}
+
+// Encode formats the header for the wire in its version, including the
+// terminating newline(s).
+func (h Header) Encode() string {
+	if h.Version < Version2 {
+		return h.String() + "\n"
+	}
+	fields := make(map[string]string, len(h.Fields)+2)
+	for key, value := range h.Fields {
+		fields[key] = value
+	}
+	fields[keyNodeID] = h.NodeID
+	fields[keyCapabilities] = strings.Join(h.Caps, ", ")
+	return encodeBlock(h.Type, fields)
+}
+
+// ReadHeader reads a v1 line or a v2 block. On error the returned header
+// still carries the version that was detected, so the caller can answer in
+// kind.
+func ReadHeader(r LineReader) (Header, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return Header{}, err
+	}
+	if !strings.HasPrefix(line, versionPrefix) {
+		return ParseHeader(line)
+	}
+	version, verb, err := parseStatusLine(line)
+	if err != nil {
+		return Header{Version: Version2}, err
+	}
+	fields, err := readBlock(r)
+	if err != nil {
+		return Header{Version: version}, err
+	}
+	h := Header{
+		Version: version,
+		Type:    strings.ToUpper(verb),
+		NodeID:  fields[keyNodeID],
+		Caps:    splitList(fields[keyCapabilities]),
+	}
+	delete(fields, keyNodeID)
+	delete(fields, keyCapabilities)
+	h.Fields = fields
+	if h.Type == "" {
+		return h, fmt.Errorf("missing type")
+	}
+	if h.NodeID == "" && h.Type != TypeList && h.Type != TypePair {
+		return h, fmt.Errorf("missing node-id")
+	}
+	return h, nil
+}
+
+// Encode formats a successful reply in its version.
+func (r Reply) Encode() string {
+	if r.Version < Version2 {
+		return OK(legacyFields(r.Fields, r.Caps)) + "\n"
+	}
+	fields := make(map[string]string, len(r.Fields)+1)
+	for key, value := range r.Fields {
+		fields[key] = value
+	}
+	fields[keyCapabilities] = strings.Join(r.Caps, ", ")
+	return encodeBlock("OK", fields)
+}
+
+// ErrorReply formats a failed reply in version.
+func ErrorReply(version int, reason string) string {
+	if version < Version2 {
+		return "ERROR: " + reason + "\n"
+	}
+	return encodeBlock("ERROR", map[string]string{keyReason: reason})
+}
+
+// ReadReply reads a v1 line or a v2 block. An ERROR reply is returned as a
+// *RemoteError in either version.
+func ReadReply(r LineReader) (Reply, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return Reply{}, err
+	}
+	return readReply(r, line)
+}
+
+// readReply parses a reply whose first line has already been read.
+func readReply(r LineReader, line string) (Reply, error) {
+	if !strings.HasPrefix(line, versionPrefix) {
+		return ParseReply(line)
+	}
+	version, verb, err := parseStatusLine(line)
+	if err != nil {
+		return Reply{}, err
+	}
+	fields, err := readBlock(r)
+	if err != nil {
+		return Reply{}, err
+	}
+	switch verb {
+	case "OK":
+	case "ERROR":
+		return Reply{}, &RemoteError{Reason: fields[keyReason]}
+	default:
+		return Reply{}, fmt.Errorf("unexpected server response %q", strings.TrimSpace(line))
+	}
+	reply := Reply{Version: version, Caps: splitList(fields[keyCapabilities])}
+	delete(fields, keyCapabilities)
+	reply.Fields = fields
+	return reply, nil
+}
+
+// Handshake forms Negotiate tries, newest first. versionBare is a v1 line
+// with only the type and node-id, for servers that predate header fields.
+const (
+	versionBare = iota
+	versionFields
+	versionBlock
+)
+
+// negotiated remembers the form each server accepted, so later handshakes
+// do not dial twice. It is forgotten when the server cannot be reached.
+var negotiated sync.Map
+
+// Negotiate sends h over a connection from dial and reads the reply. It
+// starts with a v2 block; a server that answers in v1 form gets h again as
+// a v1 line on a fresh connection, and one that rejects that line as an
+// invalid header gets a bare "TYPE NODE-ID" line without fields or
+// capabilities; LIST has no node-id and fails with that error. The form that worked is remembered for server. On success
+// the connection and the reader holding any bytes after the reply are
+// returned.
+func Negotiate(server string, dial func() (net.Conn, error), h Header) (net.Conn, *bufio.Reader, Reply, error) {
+	form := versionBlock
+	if known, ok := negotiated.Load(server); ok {
+		form = known.(int)
+	}
+	for ; form >= versionBare; form-- {
+		conn, reader, line, err := sendHeader(dial, headerForm(h, form))
+		if err != nil {
+			// The server may come back upgraded; start over next time.
+			negotiated.Delete(server)
+			return nil, nil, Reply{}, err
+		}
+		if form == versionBlock && !strings.HasPrefix(line, versionPrefix) {
+			// A v1 server rejected the unknown type; try again in v1.
+			conn.Close()
+			continue
+		}
+		reply, err := readReply(reader, line)
+		var remote *RemoteError
+		// A bare line needs a node-id; LIST gets the server's error.
+		if form == versionFields && h.NodeID != "" && errors.As(err, &remote) && remote.Reason == "invalid header" {
+			conn.Close()
+			continue
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, Reply{}, err
+		}
+		negotiated.Store(server, form)
+		return conn, reader, reply, nil
+	}
+	return nil, nil, Reply{}, ErrUnsupportedVersion
+}
+
+// headerForm returns h as sent in form.
+func headerForm(h Header, form int) Header {
+	switch form {
+	case versionBlock:
+		h.Version = Version2
+	case versionFields:
+		h.Version = Version1
+	default:
+		h = Header{Version: Version1, Type: h.Type, NodeID: h.NodeID}
+	}
+	return h
+}
+
+// sendHeader writes h on a new connection and reads the first reply line.
+func sendHeader(dial func() (net.Conn, error), h Header) (net.Conn, *bufio.Reader, string, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if _, err := conn.Write([]byte(h.Encode())); err != nil {
+		conn.Close()
+		return nil, nil, "", fmt.Errorf("send header: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, "", fmt.Errorf("read reply: %w", err)
+	}
+	return conn, reader, line, nil
+}
+
+func parseStatusLine(line string) (int, string, error) {
+	proto, verb, _ := strings.Cut(strings.TrimSpace(line), " ")
+	version, err := strconv.Atoi(strings.TrimPrefix(proto, versionPrefix))
+	if err != nil {
+		return 0, "", fmt.Errorf("malformed version %q", proto)
+	}
+	if version != Version2 {
+		return version, "", ErrUnsupportedVersion
+	}
+	return version, strings.TrimSpace(verb), nil
+}
+
+// readBlock reads "key: value" lines up to an empty line.
+func readBlock(r LineReader) (map[string]string, error) {
+	fields := make(map[string]string)
+	for i := 0; ; i++ {
+		if i == maxBlockLines {
+			return nil, fmt.Errorf("more than %d header lines", maxBlockLines)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return fields, nil
+		}
+		key, value, ok := strings.Cut(line, ":")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !ok || key == "" {
+			return nil, fmt.Errorf("malformed header line %q", line)
+		}
+		fields[key] = strings.TrimSpace(value)
+	}
+}
+
+var blockValue = strings.NewReplacer("\r", " ", "\n", " ")
+
+func encodeBlock(verb string, fields map[string]string) string {
+	var b strings.Builder
+	b.WriteString(versionPrefix + strconv.Itoa(Version2) + " " + verb + "\n")
+	for _, key := range sortedKeys(fields) {
+		b.WriteString(key + ": " + blockValue.Replace(fields[key]) + "\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServer accepts handshakes like a server speaking up to version, where
+// version 0 is a v1 server that predates header fields.
+type fakeServer struct {
+	version int
+	mu      sync.Mutex
+	sent    []string
+}
+
+// forget drops what Negotiate remembers about the test's server.
+func forget(t *testing.T) {
+	negotiated.Delete(t.Name())
+	t.Cleanup(func() { negotiated.Delete(t.Name()) })
+}
+
+func (s *fakeServer) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	go s.serve(server)
+	return client, nil
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.sent = append(s.sent, strings.TrimSpace(line))
+	s.mu.Unlock()
+
+	var reply string
+	switch {
+	case strings.HasPrefix(line, versionPrefix) && s.version >= Version2:
+		if _, err := readBlock(r); err != nil {
+			return
+		}
+		reply = Reply{Version: Version2, Fields: map[string]string{FieldSession: "s2"}}.Encode()
+	case strings.Contains(line, "=") && s.version == 0:
+		reply = ErrorReply(Version1, "invalid header")
+	case strings.HasPrefix(line, versionPrefix):
+		reply = ErrorReply(Version1, "unknown type")
+	default:
+		reply = OK(map[string]string{FieldSession: "s1"}) + "\n"
+	}
+	conn.Write([]byte(reply))
+	// Hold the connection until the client is done with it.
+	r.ReadString('\n')
+}
+
+func (s *fakeServer) headers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sent := s.sent
+	s.sent = nil
+	return sent
+}
+
+func TestNegotiate(t *testing.T) {
+	header := Header{Type: TypeAgent, NodeID: "web-1", Fields: map[string]string{FieldToken: "t"}, Caps: []string{CapPair}}
+	tests := []struct {
+		name        string
+		version     int
+		wantVersion int
+		// first and again are the header lines sent on the first and the
+		// second handshake.
+		first []string
+		again []string
+	}{
+		{
+			name:        "v2 server",
+			version:     Version2,
+			wantVersion: Version2,
+			first:       []string{"MSSH/2 AGENT"},
+			again:       []string{"MSSH/2 AGENT"},
+		},
+		{
+			name:        "v1 server",
+			version:     Version1,
+			wantVersion: Version1,
+			first:       []string{"MSSH/2 AGENT", "AGENT web-1 notify=pair token=t"},
+			again:       []string{"AGENT web-1 notify=pair token=t"},
+		},
+		{
+			name:        "v1 server without fields",
+			version:     0,
+			wantVersion: Version1,
+			first:       []string{"MSSH/2 AGENT", "AGENT web-1 notify=pair token=t", "AGENT web-1"},
+			again:       []string{"AGENT web-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forget(t)
+			srv := &fakeServer{version: tt.version}
+			for i, want := range [][]string{tt.first, tt.again} {
+				conn, _, reply, err := Negotiate(t.Name(), srv.dial, header)
+				if err != nil {
+					t.Fatalf("handshake %d: %v", i+1, err)
+				}
+				conn.Close()
+				if reply.Version != tt.wantVersion {
+					t.Errorf("handshake %d: version = %d, want %d", i+1, reply.Version, tt.wantVersion)
+				}
+				if got := srv.headers(); strings.Join(got, "|") != strings.Join(want, "|") {
+					t.Errorf("handshake %d: sent %q, want %q", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNegotiateListWithoutFields(t *testing.T) {
+	forget(t)
+	srv := &fakeServer{version: 0}
+	_, _, _, err := Negotiate(t.Name(), srv.dial, Header{Type: TypeList, Fields: map[string]string{FieldToken: "t"}})
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Reason != "invalid header" {
+		t.Fatalf("err = %v, want the server's invalid header error", err)
+	}
+}
+
+func TestNegotiateForgetsUnreachableServer(t *testing.T) {
+	forget(t)
+	srv := &fakeServer{version: Version1}
+	header := Header{Type: TypeClient, NodeID: "web-1"}
+	conn, _, _, err := Negotiate(t.Name(), srv.dial, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	down := errors.New("connection refused")
+	if _, _, _, err := Negotiate(t.Name(), func() (net.Conn, error) { return nil, down }, header); !errors.Is(err, down) {
+		t.Fatalf("err = %v, want %v", err, down)
+	}
+
+	// The server came back upgraded: the v2 block is tried first again.
+	srv.version = Version2
+	srv.headers()
+	conn, _, reply, err := Negotiate(t.Name(), srv.dial, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if reply.Version != Version2 {
+		t.Errorf("version = %d, want %d", reply.Version, Version2)
+	}
+}
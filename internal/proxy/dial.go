@@ -1,38 +1,80 @@
 package proxy
 
 import (
-	"bufio"
 	"fmt"
+	"math"
 	"net"
-	"strings"
+	"strconv"
 
+	"github.com/eznix86/mssh/internal/logging"
+	"github.com/eznix86/mssh/internal/protocol"
+	"github.com/eznix86/mssh/internal/punch"
 	"github.com/eznix86/mssh/internal/stream"
 )
 
-// Dial establishes a rendezvous proxy connection and returns a buffered connection.
+// Dial establishes a rendezvous proxy connection and returns a buffered
+// connection. With opts.Direct it is a direct connection to the agent when
+// one can be opened.
 func Dial(opts Options) (*stream.BufferedConn, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+	log := logging.Component("proxy").With(logging.KeyNodeID, opts.NodeID)
+	header := protocol.Header{
+		Type:   protocol.TypeClient,
+		NodeID: opts.NodeID,
+		Fields: map[string]string{
+			protocol.FieldService: opts.Service,
+			protocol.FieldToken:   opts.Token,
+		},
+	}
+	if opts.Wait > 0 {
+		header.Fields[protocol.FieldWait] = strconv.Itoa(int(math.Ceil(opts.Wait.Seconds())))
+	}
+	dial := opts.dial
+	var ep *punch.Endpoint
+	// Punching needs a TCP port shared with the server connection.
+	if opts.Direct && (opts.QUIC || opts.WebSocket != "") {
+		log.Warn("--direct is not supported over QUIC or WebSocket; using the relay")
+	}
+	if opts.Direct && !opts.QUIC && opts.WebSocket == "" {
+		var err error
+		if ep, err = punch.Listen(); err != nil {
+			log.Debug("direct connections unavailable", logging.Err(err))
+		} else {
+			defer ep.Close()
+			header.Caps = []string{protocol.CapDirect}
+			header.Fields[protocol.FieldAddrs] = protocol.FormatAddrs(ep.Addrs())
+			// Only the first attempt can use the endpoint's port; a v1 retry
+			// would reuse the same address pair.
+			first := true
+			dial = func() (net.Conn, error) {
+				if first {
+					first = false
+					return opts.dialWith(ep.Dialer())
+				}
+				return opts.dial()
+			}
+		}
+	}
+	conn, reader, reply, err := protocol.Negotiate(opts.server(), dial, header)
 	if err != nil {
-		return nil, fmt.Errorf("connect proxy server: %w", err)
+		return nil, err
 	}
+	session := reply.Field(protocol.FieldSession)
+	log = log.With(logging.KeySessionID, session)
+	log.Debug("paired with agent")
 
-	if _, err := fmt.Fprintf(conn, "CLIENT %s\n", opts.NodeID); err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("send client header: %w", err)
+	relay := stream.Wrap(conn, reader)
+	if ep == nil || !reply.Has(protocol.CapDirect) {
+		return relay, nil
 	}
-
-	reader := bufio.NewReader(conn)
-	response, err := reader.ReadString('\n')
+	peer, direct, err := punch.Initiate(ep, relay, protocol.ParseAddrs(reply.Field(protocol.FieldPeerAddrs)), session)
 	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("reading server response: %w", err)
+		relay.Close()
+		return nil, fmt.Errorf("choose connection path: %w", err)
 	}
-
-	trim := strings.TrimSpace(response)
-	if strings.HasPrefix(trim, "ERROR:") {
-		conn.Close()
-		return nil, fmt.Errorf(trim)
+	if direct {
+		log.Debug("connected directly to agent", "remote_addr", peer.RemoteAddr().String())
+	} else {
+		log.Debug("no direct connection to agent, using relay")
 	}
-
-	return stream.Wrap(conn, reader), nil
+	return peer, nil
 }
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+
+	"github.com/eznix86/mssh/internal/logging"
+	"github.com/eznix86/mssh/internal/protocol"
+)
+
+// Node is one registered agent as reported by LIST.
+type Node struct {
+	// ID is the node-id, or node-id/service for additional services.
+	ID string
+	// Meta holds the reported metadata (see protocol.MetaFields) and Tags
+	// the parsed user-defined tags; both are empty for servers that do not
+	// report metadata.
+	Meta map[string]string
+	Tags map[string]string
+}
+
+// ErrNoMetadata is returned when filtering by tag on a server that does not
+// report node metadata.
+var ErrNoMetadata = errors.New("server does not report node metadata; cannot filter by tag")
+
+// ListNodes asks the rendezvous server for all registered agents. When tags
+// is non-empty only nodes carrying every tag are returned. Malformed node
+// lines are logged and skipped so one bad agent does not hide the rest.
+func ListNodes(opts Options, tags map[string]string) ([]Node, error) {
+	header := protocol.Header{
+		Type:   protocol.TypeList,
+		Fields: map[string]string{protocol.FieldToken: opts.Token},
+		Caps:   []string{protocol.CapMeta},
+	}
+	conn, reader, reply, err := protocol.Negotiate(opts.server(), opts.dial, header)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if len(tags) > 0 && !reply.Has(protocol.CapMeta) {
+		return nil, ErrNoMetadata
+	}
+
+	log := logging.Component("proxy")
+	var nodes []Node
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		id, meta, err := protocol.ParseNodeLine(line)
+		if err != nil {
+			log.Warn("skipping malformed node line", "line", line, logging.Err(err))
+			continue
+		}
+		node := Node{ID: id, Meta: meta}
+		if node.Tags, err = protocol.ParseTags(meta[protocol.FieldTags]); err != nil {
+			log.Warn("skipping node with malformed tags", logging.KeyNodeID, id, logging.Err(err))
+			continue
+		}
+		if node.matches(tags) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, scanner.Err()
+}
+
+func (n Node) matches(tags map[string]string) bool {
+	for key, value := range tags {
+		if have, ok := n.Tags[key]; !ok || have != value {
+			return false
+		}
+	}
+	return true
+}
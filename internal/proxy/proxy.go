@@ -1,9 +1,13 @@
 package proxy
 
 import (
+	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"time"
+
+	"github.com/eznix86/mssh/internal/transport"
 )
 
 // Options describes how to connect to the rendezvous server.
@@ -11,15 +15,77 @@ type Options struct {
 	Host   string
 	Port   int
 	NodeID string
+	// Service selects one of several services an agent exposes for the node;
+	// empty means the default SSH service.
+	Service string
+	// Token authenticates the client to the rendezvous server.
+	Token string
+	TLS   transport.TLSOptions
+	// QUIC reaches the server over QUIC instead of TCP.
+	QUIC bool
+	// WebSocket is the ws:// or wss:// URL to reach the server through when
+	// only HTTP gets out.
+	WebSocket string
+	// Direct tries a peer-to-peer connection to the agent (see package
+	// punch) and keeps the relay through the server if that fails.
+	Direct bool
+	// Wait asks the server to hold the connection until the agent registers,
+	// for up to this long, instead of failing right away when it is offline.
+	Wait time.Duration
 }
 
-// ParseServerAddr converts host:port to Options with network fields populated.
+// ParseServerAddr converts host:port, quic://host:port or a ws:// or wss://
+// URL to Options with network fields populated.
 func ParseServerAddr(addr string) (Options, error) {
+	wsURL, addr, err := transport.SplitWebSocket(addr)
+	if err != nil {
+		return Options{}, err
+	}
+	addr, quic := transport.SplitScheme(addr)
 	host, port, err := parseAddr(addr)
 	if err != nil {
 		return Options{}, err
 	}
-	return Options{Host: host, Port: port}, nil
+	return Options{Host: host, Port: port, QUIC: quic, WebSocket: wsURL}, nil
+}
+
+// server returns the server address as configured, to tell servers apart.
+func (o Options) server() string {
+	addr := net.JoinHostPort(o.Host, strconv.Itoa(o.Port))
+	switch {
+	case o.WebSocket != "":
+		return o.WebSocket
+	case o.QUIC:
+		return "quic://" + addr
+	}
+	return addr
+}
+
+// dial connects to the rendezvous server.
+func (o Options) dial() (net.Conn, error) {
+	return o.dialWith(&net.Dialer{})
+}
+
+func (o Options) dialWith(dialer *net.Dialer) (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if o.Token != "" {
+		transport.WarnPlaintextToken(o.server(), o.WebSocket, o.QUIC, o.TLS)
+	}
+	switch {
+	case o.QUIC:
+		conn, err = transport.DialQUIC(o.Host, o.Port, o.TLS)
+	case o.WebSocket != "":
+		conn, err = transport.DialWebSocket(o.WebSocket, o.TLS)
+	default:
+		conn, err = transport.DialWith(dialer, o.Host, o.Port, o.TLS)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect proxy server: %w", err)
+	}
+	return conn, nil
 }
 
 // Run dials the rendezvous server and proxies stdin/stdout through it.
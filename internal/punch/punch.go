@@ -0,0 +1,276 @@
+// Package punch opens direct TCP connections between a client and an agent
+// behind NAT, using the addresses exchanged through the rendezvous server.
+//
+// Each side connects to the server from an Endpoint, a local port that is
+// also listening, so the NAT mapping the server observes is the one the
+// peer is told about. Both sides then dial each other's addresses from that
+// port while accepting on it; crossing SYNs open the mappings (TCP
+// simultaneous open). The client sends a hello carrying the session ID on
+// the first connection it gets and the agent keeps the first connection
+// with a valid hello. When nothing connects within Timeout the session
+// stays on the relay.
+package punch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eznix86/mssh/internal/protocol"
+	"github.com/eznix86/mssh/internal/stream"
+)
+
+// Timeout bounds a punching attempt before falling back to the relay.
+const Timeout = 3 * time.Second
+
+// retryInterval paces dial attempts to each peer address.
+const retryInterval = 100 * time.Millisecond
+
+const helloPrefix = "MSSH-DIRECT "
+
+// Endpoint is a local TCP port used both to reach the rendezvous server and
+// to punch through to the peer.
+type Endpoint struct {
+	ln   net.Listener
+	port int
+}
+
+// Listen reserves a port for an Endpoint. It fails on platforms that cannot
+// share a port between a listener and outgoing connections.
+func Listen() (*Endpoint, error) {
+	lc := net.ListenConfig{Control: control}
+	ln, err := lc.Listen(context.Background(), "tcp", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("listen for direct connections: %w", err)
+	}
+	return &Endpoint{ln: ln, port: ln.Addr().(*net.TCPAddr).Port}, nil
+}
+
+// Dialer returns a dialer that connects from the endpoint's port.
+func (e *Endpoint) Dialer() *net.Dialer {
+	return &net.Dialer{
+		LocalAddr: &net.TCPAddr{Port: e.port},
+		Control:   control,
+	}
+}
+
+// Addrs lists the endpoint's port on each non-loopback interface address,
+// for peers on the same network.
+func (e *Endpoint) Addrs() []string {
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	port := strconv.Itoa(e.port)
+	var addrs []string
+	for _, addr := range ifAddrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(ipNet.IP.String(), port))
+	}
+	return addrs
+}
+
+// Close stops listening. Connections made from the endpoint stay open.
+func (e *Endpoint) Close() error {
+	return e.ln.Close()
+}
+
+// Initiate is the client side: it tries to reach the agent at peers and
+// tells it through relay which path the session takes. It returns the
+// direct connection, or relay when punching failed, and whether the
+// connection is direct. The endpoint is closed.
+func Initiate(ep *Endpoint, relay *stream.BufferedConn, peers []string, session string) (*stream.BufferedConn, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	direct, err := ep.connect(ctx, peers, session, true)
+	if err != nil {
+		if _, err := io.WriteString(relay, protocol.RelayChosen+"\n"); err != nil {
+			return nil, false, err
+		}
+		return relay, false, nil
+	}
+	if _, err := io.WriteString(relay, protocol.DirectChosen+"\n"); err != nil {
+		direct.Close()
+		return nil, false, err
+	}
+	relay.Close()
+	return direct, true, nil
+}
+
+// Respond is the agent side: it accepts the client's direct connection
+// while waiting for the client's decision on relay, and returns the
+// connection the session takes. The endpoint is closed.
+func Respond(ep *Endpoint, relay *stream.BufferedConn, peers []string, session string) (*stream.BufferedConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*Timeout)
+	defer cancel()
+	type result struct {
+		conn *stream.BufferedConn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := ep.connect(ctx, peers, session, false)
+		done <- result{conn, err}
+	}()
+
+	relay.SetReadDeadline(time.Now().Add(2 * Timeout))
+	line, err := relay.ReadString('\n')
+	relay.SetReadDeadline(time.Time{})
+	if err != nil {
+		cancel()
+		if r := <-done; r.conn != nil {
+			r.conn.Close()
+		}
+		return nil, fmt.Errorf("read path decision: %w", err)
+	}
+	switch strings.TrimSpace(line) {
+	case protocol.DirectChosen:
+		r := <-done
+		if r.err != nil {
+			return nil, fmt.Errorf("client chose a direct connection: %w", r.err)
+		}
+		relay.Close()
+		return r.conn, nil
+	case protocol.RelayChosen:
+		cancel()
+		if r := <-done; r.conn != nil {
+			r.conn.Close()
+		}
+		return relay, nil
+	default:
+		cancel()
+		<-done
+		return nil, fmt.Errorf("unexpected path decision %q", strings.TrimSpace(line))
+	}
+}
+
+// connect races dialing peers against accepting on the endpoint until a
+// connection completes the hello for session, or ctx ends. It closes the
+// endpoint.
+func (e *Endpoint) connect(ctx context.Context, peers []string, session string, initiator bool) (*stream.BufferedConn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer e.ln.Close()
+	defer cancel()
+
+	raw := make(chan net.Conn)
+	offer := func(conn net.Conn) {
+		select {
+		case raw <- conn:
+		case <-ctx.Done():
+			conn.Close()
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := e.ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				offer(conn)
+			}()
+		}
+	}()
+	dialer := e.Dialer()
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if conn, err := dialer.DialContext(ctx, "tcp", peer); err == nil {
+					offer(conn)
+					return
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(retryInterval):
+				}
+			}
+		}()
+	}
+
+	verified := make(chan *stream.BufferedConn)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, errors.New("no direct connection to peer")
+		case conn := <-raw:
+			if initiator {
+				if bc, err := sendHello(conn, session); err == nil {
+					return bc, nil
+				}
+				conn.Close()
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				bc, err := readHello(ctx, conn, session)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				select {
+				case verified <- bc:
+				case <-ctx.Done():
+					conn.Close()
+				}
+			}()
+		case bc := <-verified:
+			if _, err := io.WriteString(bc, "OK\n"); err == nil {
+				return bc, nil
+			}
+			bc.Close()
+		}
+	}
+}
+
+// sendHello announces session on conn and waits for the agent to accept it.
+func sendHello(conn net.Conn, session string) (*stream.BufferedConn, error) {
+	bc := stream.New(conn)
+	if _, err := io.WriteString(bc, helloPrefix+session+"\n"); err != nil {
+		return nil, err
+	}
+	bc.SetReadDeadline(time.Now().Add(Timeout))
+	line, err := bc.ReadString('\n')
+	bc.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(line) != "OK" {
+		return nil, fmt.Errorf("direct connection refused")
+	}
+	return bc, nil
+}
+
+// readHello checks that the client on conn announces session.
+func readHello(ctx context.Context, conn net.Conn, session string) (*stream.BufferedConn, error) {
+	bc := stream.New(conn)
+	if deadline, ok := ctx.Deadline(); ok {
+		bc.SetReadDeadline(deadline)
+	}
+	line, err := bc.ReadString('\n')
+	bc.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(line) != helloPrefix+session {
+		return nil, fmt.Errorf("unexpected hello")
+	}
+	return bc, nil
+}
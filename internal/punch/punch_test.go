@@ -0,0 +1,99 @@
+package punch
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/eznix86/mssh/internal/stream"
+)
+
+func listen(t *testing.T) *Endpoint {
+	t.Helper()
+	ep, err := Listen()
+	if err != nil {
+		t.Skipf("direct connections unavailable: %v", err)
+	}
+	t.Cleanup(func() { ep.Close() })
+	return ep
+}
+
+func loopback(ep *Endpoint) []string {
+	return []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(ep.port))}
+}
+
+func TestPunch(t *testing.T) {
+	tests := []struct {
+		name string
+		// agentPeers and clientPeers return the addresses each side dials.
+		agentPeers, clientPeers func(agent, client *Endpoint) []string
+		agentSession            string
+		wantDirect              bool
+	}{
+		{
+			name:         "direct",
+			agentPeers:   func(_, client *Endpoint) []string { return loopback(client) },
+			clientPeers:  func(agent, _ *Endpoint) []string { return loopback(agent) },
+			agentSession: "s1",
+			wantDirect:   true,
+		},
+		{
+			name:         "unreachable peer falls back to relay",
+			agentPeers:   func(_, _ *Endpoint) []string { return nil },
+			clientPeers:  func(_, _ *Endpoint) []string { return nil },
+			agentSession: "s1",
+		},
+		{
+			name:         "other session falls back to relay",
+			agentPeers:   func(_, client *Endpoint) []string { return loopback(client) },
+			clientPeers:  func(agent, _ *Endpoint) []string { return loopback(agent) },
+			agentSession: "s2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			agentEP, clientEP := listen(t), listen(t)
+			// The relay stands in for the server, which pipes the two sides.
+			clientRelay, agentRelay := net.Pipe()
+
+			type result struct {
+				conn *stream.BufferedConn
+				err  error
+			}
+			responded := make(chan result, 1)
+			go func() {
+				conn, err := Respond(agentEP, stream.New(agentRelay), tt.agentPeers(agentEP, clientEP), tt.agentSession)
+				responded <- result{conn, err}
+			}()
+			client, direct, err := Initiate(clientEP, stream.New(clientRelay), tt.clientPeers(agentEP, clientEP), "s1")
+			if err != nil {
+				t.Fatalf("Initiate: %v", err)
+			}
+			defer client.Close()
+			r := <-responded
+			if r.err != nil {
+				t.Fatalf("Respond: %v", r.err)
+			}
+			defer r.conn.Close()
+			if direct != tt.wantDirect {
+				t.Fatalf("direct = %v, want %v", direct, tt.wantDirect)
+			}
+			if isPipe := client.RemoteAddr().Network() == "pipe"; isPipe == direct {
+				t.Errorf("client connection %v does not match direct = %v", client.RemoteAddr(), direct)
+			}
+
+			// Both sides must end up on the same connection.
+			go io.WriteString(client, "ping\n")
+			line, err := r.conn.ReadString('\n')
+			if err != nil || line != "ping\n" {
+				t.Fatalf("agent read %q, %v", line, err)
+			}
+			go io.WriteString(r.conn, "pong\n")
+			if line, err = client.ReadString('\n'); err != nil || line != "pong\n" {
+				t.Fatalf("client read %q, %v", line, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package punch
+
+import (
+	"errors"
+	"syscall"
+)
+
+// control reports that ports cannot be shared on this platform.
+func control(network, address string, c syscall.RawConn) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"path"
+	"slices"
+
+	"github.com/eznix86/mssh/internal/audit"
+	"github.com/eznix86/mssh/internal/protocol"
+)
+
+// ACL actions.
+const (
+	actionAllow = "allow"
+	actionDeny  = "deny"
+)
+
+// ACL roles: what a connection wants to do with a node-id.
+const (
+	// roleAgent registers the node-id or carries its sessions' data.
+	roleAgent = "agent"
+	// roleClient connects to the node.
+	roleClient = "client"
+	// roleList sees the node in 'mssh nodes'.
+	roleList = "list"
+)
+
+// ACLRule matches connections by role, token name, token group or TLS client
+// certificate subject, and node-ids by glob pattern. Empty lists match
+// everything. Rules are evaluated in order and the first match decides.
+type ACLRule struct {
+	Roles    []string `yaml:"roles,omitempty"`
+	Tokens   []string `yaml:"tokens,omitempty"`
+	Groups   []string `yaml:"groups,omitempty"`
+	Subjects []string `yaml:"subjects,omitempty"`
+	Nodes    []string `yaml:"nodes,omitempty"`
+	Action   string   `yaml:"action"`
+}
+
+// identity describes an authenticated peer.
+type identity struct {
+	Token  string
+	Groups []string
+	// Subject and Fingerprint come from a verified TLS client certificate;
+	// Fingerprint is SHA256:<base64> of its public key.
+	Subject     string
+	Fingerprint string
+}
+
+// newIdentity combines the matched token (nil when tokens are not in use)
+// with the peer's TLS client certificate, if any.
+func newIdentity(token *Token, conn net.Conn) identity {
+	var id identity
+	if token != nil {
+		id.Token = token.Name
+		id.Groups = token.Groups
+	}
+	// Both *tls.Conn and QUIC streams report their TLS state.
+	if tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			id.Subject = certs[0].Subject.CommonName
+			sum := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+			id.Fingerprint = "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+		}
+	}
+	return id
+}
+
+// logAttrs returns the identity as log attributes, omitting empty ones.
+func (id identity) logAttrs() []any {
+	var attrs []any
+	if id.Token != "" {
+		attrs = append(attrs, "token", id.Token)
+	}
+	if id.Subject != "" {
+		attrs = append(attrs, "subject", id.Subject)
+	}
+	return attrs
+}
+
+// event copies the identity into an audit event.
+func (id identity) event(ev audit.Event) audit.Event {
+	ev.Token, ev.Subject, ev.Fingerprint = id.Token, id.Subject, id.Fingerprint
+	return ev
+}
+
+// fields encodes the identity for the PAIR line.
+func (id identity) fields() map[string]string {
+	return map[string]string{
+		protocol.FieldClientToken:       protocol.EscapeValue(id.Token),
+		protocol.FieldClientSubject:     protocol.EscapeValue(id.Subject),
+		protocol.FieldClientFingerprint: protocol.EscapeValue(id.Fingerprint),
+	}
+}
+
+func (r ACLRule) validate() error {
+	if r.Action != actionAllow && r.Action != actionDeny {
+		return fmt.Errorf("acl action must be %q or %q, got %q", actionAllow, actionDeny, r.Action)
+	}
+	for _, role := range r.Roles {
+		if role != roleAgent && role != roleClient && role != roleList {
+			return fmt.Errorf("acl role must be %q, %q or %q, got %q", roleAgent, roleClient, roleList, role)
+		}
+	}
+	for _, pattern := range r.Nodes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("acl node pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (r ACLRule) matches(id identity, role, nodeID string) bool {
+	if len(r.Roles) > 0 && !slices.Contains(r.Roles, role) {
+		return false
+	}
+	if len(r.Tokens) > 0 && !slices.Contains(r.Tokens, id.Token) {
+		return false
+	}
+	if len(r.Groups) > 0 && !slices.ContainsFunc(id.Groups, func(g string) bool { return slices.Contains(r.Groups, g) }) {
+		return false
+	}
+	if len(r.Subjects) > 0 && !slices.Contains(r.Subjects, id.Subject) {
+		return false
+	}
+	if len(r.Nodes) == 0 {
+		return true
+	}
+	for _, pattern := range r.Nodes {
+		if ok, _ := path.Match(pattern, nodeID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize reports whether id may act as role for nodeID. Without a
+// matching rule the acl-default action applies, which is allow unless
+// configured otherwise.
+func (c *Config) authorize(id identity, role, nodeID string) bool {
+	for _, rule := range c.ACL {
+		if rule.matches(id, role, nodeID) {
+			return rule.Action == actionAllow
+		}
+	}
+	return c.ACLDefault != actionDeny
+}
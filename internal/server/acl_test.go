@@ -0,0 +1,176 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuthorize(t *testing.T) {
+	acl := []ACLRule{
+		{Roles: []string{roleAgent}, Tokens: []string{"fleet"}, Action: actionAllow},
+		{Roles: []string{roleAgent}, Action: actionDeny},
+		{Tokens: []string{"fleet"}, Action: actionDeny},
+		{Roles: []string{roleList}, Nodes: []string{"secret-*"}, Action: actionDeny},
+		{Groups: []string{"oncall"}, Nodes: []string{"prod-*"}, Action: actionAllow},
+		{Subjects: []string{"ci.example.com"}, Nodes: []string{"prod-web-*"}, Action: actionAllow},
+		{Nodes: []string{"prod-*"}, Action: actionDeny},
+	}
+	alice := identity{Token: "alice", Groups: []string{"dev", "oncall"}}
+	bob := identity{Token: "bob", Groups: []string{"dev"}}
+	fleet := identity{Token: "fleet"}
+	ci := identity{Subject: "ci.example.com", Fingerprint: "SHA256:x"}
+
+	tests := []struct {
+		name       string
+		aclDefault string
+		id         identity
+		role, node string
+		want       bool
+	}{
+		{"agent token registers", "", fleet, roleAgent, "prod-db-1", true},
+		{"agent token cannot connect", "", fleet, roleClient, "prod-db-1", false},
+		{"agent token cannot list", "", fleet, roleList, "web-1", false},
+		{"client cannot register", "", alice, roleAgent, "web-1", false},
+		{"client connects", "", bob, roleClient, "web-1", true},
+		{"group allowed before deny", "", alice, roleClient, "prod-db-1", true},
+		{"group not matching falls through to deny", "", bob, roleClient, "prod-db-1", false},
+		{"subject from client certificate", "", ci, roleClient, "prod-web-1", true},
+		{"subject limited to its nodes", "", ci, roleClient, "prod-db-1", false},
+		{"list rule hides nodes", "", alice, roleList, "secret-1", false},
+		{"list rule does not block clients", "", alice, roleClient, "secret-1", true},
+		{"no match uses allow by default", "", bob, roleList, "web-1", true},
+		{"no match uses acl-default", actionDeny, bob, roleClient, "web-1", false},
+		{"first match beats acl-default", actionDeny, alice, roleClient, "prod-db-1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{ACL: acl, ACLDefault: tt.aclDefault}
+			if err := cfg.validate(); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			if got := cfg.authorize(tt.id, tt.role, tt.node); got != tt.want {
+				t.Errorf("authorize(%+v, %s, %s) = %v, want %v", tt.id, tt.role, tt.node, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACLRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    ACLRule
+		wantErr bool
+	}{
+		{"allow", ACLRule{Action: actionAllow}, false},
+		{"all roles", ACLRule{Roles: []string{roleAgent, roleClient, roleList}, Action: actionDeny}, false},
+		{"missing action", ACLRule{}, true},
+		{"unknown action", ACLRule{Action: "permit"}, true},
+		{"unknown role", ACLRule{Roles: []string{"admin"}, Action: actionAllow}, true},
+		{"bad pattern", ACLRule{Nodes: []string{"prod-["}, Action: actionAllow}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewIdentity(t *testing.T) {
+	cert := selfSigned(t, "ci.example.com")
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	sum := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	fingerprint := "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name       string
+		token      *Token
+		clientCert bool
+		want       identity
+	}{
+		{"anonymous", nil, false, identity{}},
+		{"token", &Token{Name: "alice", Groups: []string{"oncall"}}, false, identity{Token: "alice", Groups: []string{"oncall"}}},
+		{"client certificate", nil, true, identity{Subject: "ci.example.com", Fingerprint: fingerprint}},
+		{"token and certificate", &Token{Name: "ci", Groups: []string{"deploy"}}, true, identity{Token: "ci", Groups: []string{"deploy"}, Subject: "ci.example.com", Fingerprint: fingerprint}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverSide, clientSide := net.Pipe()
+			defer serverSide.Close()
+			defer clientSide.Close()
+			server := tls.Server(serverSide, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+				ClientCAs:    pool,
+			})
+			clientCfg := &tls.Config{RootCAs: pool, ServerName: "ci.example.com"}
+			if tt.clientCert {
+				clientCfg.Certificates = []tls.Certificate{cert}
+			}
+			go tls.Client(clientSide, clientCfg).Handshake()
+			if err := server.Handshake(); err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+
+			got := newIdentity(tt.token, server)
+			if got.Token != tt.want.Token || got.Subject != tt.want.Subject || got.Fingerprint != tt.want.Fingerprint || len(got.Groups) != len(tt.want.Groups) {
+				t.Fatalf("newIdentity = %+v, want %+v", got, tt.want)
+			}
+			for i := range got.Groups {
+				if got.Groups[i] != tt.want.Groups[i] {
+					t.Fatalf("groups = %v, want %v", got.Groups, tt.want.Groups)
+				}
+			}
+		})
+	}
+
+	// Plain connections carry no certificate identity.
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if got := newIdentity(nil, a); got.Subject != "" || got.Fingerprint != "" {
+		t.Errorf("newIdentity(plain) = %+v", got)
+	}
+}
+
+// selfSigned returns a certificate usable both as server and client
+// certificate for name.
+func selfSigned(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
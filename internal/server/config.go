@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/eznix86/mssh/internal/audit"
+)
+
+// Config is the server configuration file. Every field is optional; a zero
+// Config behaves like the flag-only server.
+type Config struct {
+	Listeners []ListenerConfig `yaml:"listeners,omitempty"`
+	// Tokens, when non-empty, are required on every handshake.
+	Tokens []Token `yaml:"tokens,omitempty"`
+	// ACL decides who may register, reach or list which node-ids; see ACLRule.
+	ACL        []ACLRule     `yaml:"acl,omitempty"`
+	ACLDefault string        `yaml:"acl-default,omitempty"`
+	Limits     LimitsConfig  `yaml:"limits,omitempty"`
+	Logging    LoggingConfig `yaml:"logging,omitempty"`
+	Audit      audit.Options `yaml:"audit,omitempty"`
+	// RelayOnly keeps every session on the server instead of letting
+	// clients and agents connect directly, so all traffic is audited.
+	RelayOnly bool `yaml:"relay-only,omitempty"`
+}
+
+// ListenerConfig is one address the server accepts connections on.
+type ListenerConfig struct {
+	Address string `yaml:"address"`
+	// Transport is "tcp" (the default), "quic" or "websocket". QUIC
+	// listeners need TLS.
+	Transport string `yaml:"transport,omitempty"`
+	// Path is where WebSocket listeners accept upgrades; it defaults to "/".
+	Path string `yaml:"path,omitempty"`
+	// TrustedProxies are the addresses or CIDR ranges of reverse proxies in
+	// front of a WebSocket listener whose X-Forwarded-For header names the
+	// client.
+	TrustedProxies []string     `yaml:"trusted-proxies,omitempty"`
+	TLS            *ListenerTLS `yaml:"tls,omitempty"`
+}
+
+// Listener transports.
+const (
+	transportTCP       = "tcp"
+	transportQUIC      = "quic"
+	transportWebSocket = "websocket"
+)
+
+// key identifies the listener, so a changed transport, path or set of
+// trusted proxies replaces it on reload.
+func (l ListenerConfig) key() string {
+	switch l.Transport {
+	case transportQUIC:
+		return transportQUIC + "/" + l.Address
+	case transportWebSocket:
+		return transportWebSocket + "/" + l.Address + l.path() + " " + strings.Join(l.TrustedProxies, ",")
+	}
+	return l.Address
+}
+
+// socket names the port the listener binds; QUIC uses UDP, so it may share
+// an address with a TCP or WebSocket listener.
+func (l ListenerConfig) socket() string {
+	if l.Transport == transportQUIC {
+		return "udp/" + l.Address
+	}
+	return "tcp/" + l.Address
+}
+
+func (l ListenerConfig) path() string {
+	if l.Path == "" {
+		return "/"
+	}
+	return l.Path
+}
+
+// trustedProxies parses TrustedProxies; a bare address is a single-host
+// range.
+func (l ListenerConfig) trustedProxies() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range l.TrustedProxies {
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", value)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// ListenerTLS terminates TLS on a listener. ClientCA enables mutual TLS.
+type ListenerTLS struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client-ca,omitempty"`
+}
+
+// Token is a shared secret identifying a client or agent.
+type Token struct {
+	Name   string   `yaml:"name"`
+	Secret string   `yaml:"secret"`
+	Groups []string `yaml:"groups,omitempty"`
+}
+
+// LimitsConfig bounds resource usage; zero values mean unlimited or the default.
+type LimitsConfig struct {
+	MaxAgents        int           `yaml:"max-agents,omitempty"`
+	MaxSessions      int           `yaml:"max-sessions,omitempty"`
+	HandshakeTimeout time.Duration `yaml:"handshake-timeout,omitempty"`
+	// MaxWait caps how long a client may ask to wait for an agent.
+	MaxWait time.Duration `yaml:"max-wait,omitempty"`
+}
+
+// LoggingConfig controls where server logs go.
+type LoggingConfig struct {
+	// File receives log output instead of stderr; it is reopened on reload so
+	// it can be rotated with logrotate.
+	File string `yaml:"file,omitempty"`
+}
+
+const (
+	defaultHandshakeTimeout = 30 * time.Second
+	defaultMaxWait          = 5 * time.Minute
+)
+
+// LoadConfig reads and validates a server config file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+func (c *Config) validate() error {
+	seen := map[string]bool{}
+	for _, l := range c.Listeners {
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return fmt.Errorf("listener %q: %w", l.Address, err)
+		}
+		switch l.Transport {
+		case "", transportTCP:
+		case transportQUIC:
+			if l.TLS == nil {
+				return fmt.Errorf("listener %q: quic needs tls", l.Address)
+			}
+		case transportWebSocket:
+			if !strings.HasPrefix(l.path(), "/") {
+				return fmt.Errorf("listener %q: path must start with /", l.Address)
+			}
+		default:
+			return fmt.Errorf("listener %q: transport must be %q, %q or %q", l.Address, transportTCP, transportQUIC, transportWebSocket)
+		}
+		if l.Path != "" && l.Transport != transportWebSocket {
+			return fmt.Errorf("listener %q: path is only used by websocket listeners", l.Address)
+		}
+		if len(l.TrustedProxies) > 0 && l.Transport != transportWebSocket {
+			return fmt.Errorf("listener %q: trusted-proxies is only used by websocket listeners", l.Address)
+		}
+		if _, err := l.trustedProxies(); err != nil {
+			return fmt.Errorf("listener %q: %w", l.Address, err)
+		}
+		if seen[l.socket()] {
+			return fmt.Errorf("listener %q defined twice", l.Address)
+		}
+		seen[l.socket()] = true
+		if l.TLS != nil {
+			if _, err := l.TLS.config(); err != nil {
+				return fmt.Errorf("listener %q: %w", l.Address, err)
+			}
+		}
+	}
+	names := map[string]bool{}
+	for _, t := range c.Tokens {
+		if t.Name == "" || t.Secret == "" {
+			return fmt.Errorf("tokens need a name and a secret")
+		}
+		if names[t.Name] {
+			return fmt.Errorf("token %q defined twice", t.Name)
+		}
+		names[t.Name] = true
+	}
+	for i, rule := range c.ACL {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("acl rule %d: %w", i+1, err)
+		}
+	}
+	if c.ACLDefault != "" && c.ACLDefault != actionAllow && c.ACLDefault != actionDeny {
+		return fmt.Errorf("acl-default must be %q or %q", actionAllow, actionDeny)
+	}
+	if c.Limits.MaxAgents < 0 || c.Limits.MaxSessions < 0 || c.Limits.HandshakeTimeout < 0 || c.Limits.MaxWait < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// config loads the certificate and client CA for a TLS listener.
+func (t *ListenerTLS) config() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if t.ClientCA != "" {
+		pem, err := os.ReadFile(t.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.ClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// authenticate returns the token matching secret. With no tokens configured
+// every peer is accepted anonymously and nil is returned.
+func (c *Config) authenticate(secret string) (*Token, error) {
+	if len(c.Tokens) == 0 {
+		return nil, nil
+	}
+	for i := range c.Tokens {
+		if subtle.ConstantTimeCompare([]byte(c.Tokens[i].Secret), []byte(secret)) == 1 {
+			return &c.Tokens[i], nil
+		}
+	}
+	return nil, errUnauthorized
+}
+
+var errUnauthorized = errors.New("unauthorized")
+
+func (c *Config) handshakeTimeout() time.Duration {
+	if c.Limits.HandshakeTimeout > 0 {
+		return c.Limits.HandshakeTimeout
+	}
+	return defaultHandshakeTimeout
+}
+
+// clientWait returns how long to hold a client that asked to wait for
+// requested, capped at the max-wait limit.
+func (c *Config) clientWait(requested time.Duration) time.Duration {
+	max := c.Limits.MaxWait
+	if max == 0 {
+		max = defaultMaxWait
+	}
+	return min(requested, max)
+}
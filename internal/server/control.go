@@ -0,0 +1,167 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eznix86/mssh/internal/logging"
+	"github.com/eznix86/mssh/internal/protocol"
+	"github.com/eznix86/mssh/internal/stream"
+)
+
+// pendingSession is a client waiting for a control agent to dial the data
+// connection for its session.
+type pendingSession struct {
+	agent *agentConn
+	// clientAddrs are the client's direct connection candidates, if any.
+	clientAddrs []string
+	// result receives exactly one outcome; it is buffered so delivering
+	// never blocks.
+	result chan dataResult
+}
+
+type dataResult struct {
+	conn *stream.BufferedConn
+	// peerAddrs are the agent's direct connection candidates, set when
+	// both sides asked for one.
+	peerAddrs []string
+	err       error
+}
+
+var (
+	errAgentGone      = errors.New("agent disconnected")
+	errAgentForbidden = errors.New("agent forbidden by ACL")
+	// errNoDataConn fails one session; the control channel may still be
+	// fine.
+	errNoDataConn = errors.New("no data connection from agent")
+)
+
+// serveControl reads REFUSE messages from the control channel of agent until
+// it closes, then removes the registration and fails its pending sessions.
+func (s *Server) serveControl(key string, agent *agentConn) {
+	var err error
+	for {
+		var msg protocol.Header
+		if msg, err = protocol.ReadHeader(agent.conn); err != nil {
+			break
+		}
+		if msg.Type != protocol.TypeRefuse {
+			err = fmt.Errorf("unexpected %s message", msg.Type)
+			break
+		}
+		reason := msg.Field(protocol.FieldReason)
+		s.deliver(agent, msg.Field(protocol.FieldSession), dataResult{err: fmt.Errorf("%w: %s", errRefused, reason)})
+	}
+	if s.dropAgent(key, agent) {
+		agent.log.Info("agent disconnected", logging.Err(err))
+	}
+
+	s.mu.Lock()
+	for session, p := range s.pending {
+		if p.agent == agent {
+			delete(s.pending, session)
+			p.result <- dataResult{err: errAgentGone}
+		}
+	}
+	s.mu.Unlock()
+}
+
+// dropAgent unregisters agent if it is still registered under key and
+// closes its connection. It reports whether the agent was registered.
+func (s *Server) dropAgent(key string, agent *agentConn) bool {
+	s.mu.Lock()
+	current := s.agents[key] == agent
+	if current {
+		delete(s.agents, key)
+	}
+	s.mu.Unlock()
+	agent.conn.Close()
+	return current
+}
+
+// openSession sends PAIR for the client's session on the control channel of
+// agent and waits for the agent to dial the data connection or refuse.
+func (s *Server) openSession(hs *handshake, agent *agentConn) dataResult {
+	session := hs.ev.Session
+	p := &pendingSession{agent: agent, clientAddrs: hs.addrs, result: make(chan dataResult, 1)}
+	s.mu.Lock()
+	s.pending[session] = p
+	s.mu.Unlock()
+
+	timeout := hs.cfg.handshakeTimeout()
+	agent.wmu.Lock()
+	agent.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := agent.conn.Write([]byte(agent.pairHeader(hs.peer, session, hs.addrs != nil).Encode()))
+	agent.conn.SetWriteDeadline(time.Time{})
+	agent.wmu.Unlock()
+	if err != nil {
+		s.deliver(agent, session, dataResult{err: err})
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-p.result:
+		return r
+	case <-timer.C:
+	}
+	// The data connection may have been delivered meanwhile; either way the
+	// channel holds exactly one result after this.
+	s.deliver(agent, session, dataResult{err: fmt.Errorf("%w within %s", errNoDataConn, timeout)})
+	return <-p.result
+}
+
+// deliver completes the pending session if it belongs to agent. It reports
+// whether the session was still pending.
+func (s *Server) deliver(agent *agentConn, session string, r dataResult) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pending[session]
+	if !ok || p.agent != agent {
+		return false
+	}
+	delete(s.pending, session)
+	p.result <- r
+	return true
+}
+
+// acceptData hands a DATA connection to the client waiting for its session.
+// It must come from the agent registered under key, with the same identity
+// as its control channel.
+func (s *Server) acceptData(hs *handshake, header protocol.Header, key string) {
+	session := header.Field(protocol.FieldSession)
+	hs.ev.Session = session
+	hs.log = hs.log.With(logging.KeySessionID, session)
+
+	s.mu.Lock()
+	p, ok := s.pending[session]
+	ok = ok && s.agents[key] == p.agent &&
+		p.agent.peer.Token == hs.peer.Token && p.agent.peer.Fingerprint == hs.peer.Fingerprint
+	s.mu.Unlock()
+	if !ok {
+		hs.log.Warn("rejecting data connection: unknown session")
+		s.reject(hs, "unknown session")
+		return
+	}
+	// The ACL may have changed on reload since the agent registered.
+	if !hs.cfg.authorize(hs.peer, roleAgent, nodeIDOf(key)) {
+		hs.log.Warn("rejecting data connection: forbidden by ACL")
+		s.reject(hs, "forbidden")
+		s.deliver(p.agent, session, dataResult{err: errAgentForbidden})
+		return
+	}
+	r := dataResult{conn: hs.conn}
+	if p.clientAddrs != nil && hs.addrs != nil {
+		hs.reply(map[string]string{protocol.FieldPeerAddrs: protocol.FormatAddrs(p.clientAddrs)}, []string{protocol.CapDirect})
+		r.peerAddrs = hs.addrs
+	} else {
+		hs.reply(nil, nil)
+	}
+	if !s.deliver(p.agent, session, r) {
+		hs.log.Warn("data connection arrived too late")
+		hs.conn.Close()
+		return
+	}
+	hs.log.Debug("data connection accepted")
+}
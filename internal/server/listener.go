@@ -0,0 +1,169 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/eznix86/mssh/internal/logging"
+	"github.com/eznix86/mssh/internal/transport"
+)
+
+// listener accepts connections on one address. Its TLS config can be
+// replaced on reload without closing the socket.
+type listener struct {
+	net.Listener
+	tls    atomic.Pointer[tls.Config]
+	closed atomic.Bool
+	// transport is the configured transport; QUIC and WebSocket listeners
+	// yield connections whose TLS, if any, is already handled.
+	transport string
+}
+
+// Defaults for Options.Host and Options.Port.
+const (
+	defaultHost = "0.0.0.0"
+	defaultPort = 8443
+)
+
+// listenerConfigs returns the configured listeners, or the one given by
+// Options when the config has none.
+func (s *Server) listenerConfigs(cfg *Config) []ListenerConfig {
+	if len(cfg.Listeners) > 0 {
+		return cfg.Listeners
+	}
+	host, port := s.opts.Host, s.opts.Port
+	if host == "" {
+		host = defaultHost
+	}
+	if port == 0 {
+		port = defaultPort
+	}
+	return []ListenerConfig{{Address: net.JoinHostPort(host, strconv.Itoa(port))}}
+}
+
+// checkAddress rejects --host and --port when cfg defines listeners, which
+// would otherwise ignore them.
+func (s *Server) checkAddress(cfg *Config) error {
+	if len(cfg.Listeners) > 0 && (s.opts.Host != "" || s.opts.Port != 0) {
+		return errors.New("--host and --port cannot be combined with listeners in the config file")
+	}
+	return nil
+}
+
+// syncListeners opens, updates and closes listeners to match cfg. It does
+// nothing before Run has started.
+func (s *Server) syncListeners(cfg *Config) error {
+	s.lmu.Lock()
+	defer s.lmu.Unlock()
+	if s.listeners == nil {
+		return nil
+	}
+
+	wanted := map[string]bool{}
+	for _, lc := range s.listenerConfigs(cfg) {
+		wanted[lc.key()] = true
+	}
+	for key, l := range s.listeners {
+		if !wanted[key] {
+			l.closed.Store(true)
+			l.Close()
+			delete(s.listeners, key)
+			s.log.Info("stopped listening", "address", l.Addr().String(), "transport", l.transport)
+		}
+	}
+
+	var errs []error
+	for _, lc := range s.listenerConfigs(cfg) {
+		var tlsConfig *tls.Config
+		if lc.TLS != nil {
+			var err error
+			if tlsConfig, err = lc.TLS.config(); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		if l, ok := s.listeners[lc.key()]; ok {
+			l.tls.Store(tlsConfig)
+			continue
+		}
+		l := &listener{transport: lc.Transport}
+		if l.transport == "" {
+			l.transport = transportTCP
+		}
+		l.tls.Store(tlsConfig)
+		var err error
+		switch l.transport {
+		case transportQUIC:
+			l.Listener, err = transport.ListenQUIC(lc.Address, l.tls.Load)
+		case transportWebSocket:
+			// Validated with the config.
+			trusted, _ := lc.trustedProxies()
+			l.Listener, err = transport.ListenWebSocket(lc.Address, lc.path(), trusted, l.tls.Load)
+		default:
+			l.Listener, err = net.Listen("tcp", lc.Address)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.listeners[lc.key()] = l
+		s.log.Info("listening", "address", lc.Address, "tls", tlsConfig != nil, "transport", l.transport)
+		go s.serve(l)
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) serve(l *listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if l.closed.Load() {
+				return
+			}
+			s.log.Error("accept failed", "address", l.Addr().String(), logging.Err(err))
+			continue
+		}
+		if tlsConfig := l.tls.Load(); tlsConfig != nil && l.transport == transportTCP {
+			conn = tls.Server(conn, tlsConfig)
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) closeListeners() {
+	s.lmu.Lock()
+	defer s.lmu.Unlock()
+	for addr, l := range s.listeners {
+		l.closed.Store(true)
+		l.Close()
+		delete(s.listeners, addr)
+	}
+	s.listeners = nil
+}
+
+// applyLogging points log output at the configured file, reopening it so
+// rotated files are picked up.
+func (s *Server) applyLogging(cfg *Config) error {
+	s.lmu.Lock()
+	defer s.lmu.Unlock()
+	var file *os.File
+	if cfg.Logging.File != "" {
+		var err error
+		file, err = os.OpenFile(cfg.Logging.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return err
+		}
+		logging.SetOutput(file)
+	} else if s.logFile != nil {
+		logging.SetOutput(os.Stderr)
+	}
+	if s.logFile != nil {
+		s.logFile.Close()
+	}
+	s.logFile = file
+	return nil
+}
@@ -3,147 +3,764 @@ package server
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
-	"regexp"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/eznix86/mssh/internal/audit"
+	"github.com/eznix86/mssh/internal/logging"
+	"github.com/eznix86/mssh/internal/protocol"
+	"github.com/eznix86/mssh/internal/punch"
 	"github.com/eznix86/mssh/internal/stream"
 )
 
 // Options describes the server bind address.
 type Options struct {
+	// Host and Port are used when the config file defines no listeners and
+	// default to 0.0.0.0:8443. Setting either along with listeners is an
+	// error.
 	Host string
 	Port int
+	// ConfigPath is an optional server config file; Reload reads it again.
+	ConfigPath string
 }
 
 // Server implements the rendezvous service.
 type Server struct {
-	opts   Options
-	mu     sync.Mutex
-	agents map[string]*stream.BufferedConn
+	opts Options
+	cfg  atomic.Pointer[Config]
+	log  *slog.Logger
+
+	mu       sync.Mutex
+	agents   map[string]*agentConn
+	sessions int
+	// waiters holds the clients waiting for an agent, by agent key.
+	waiters map[string]*waiters
+	// pending holds the sessions waiting for a control agent's data
+	// connection, by session ID.
+	pending map[string]*pendingSession
+
+	lmu       sync.Mutex
+	listeners map[string]*listener
+	logFile   *os.File
+
+	audit *audit.Logger
 }
 
-var nodeIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+// agentConn is a registered agent waiting for a client, or the control
+// channel of an agent that dials a connection per session.
+type agentConn struct {
+	conn    *stream.BufferedConn
+	log     *slog.Logger
+	version int
+	peer    identity
+	// notify is set for agents that get a PAIR line when paired. They stay
+	// silent until then, so watchDone is closed once the watcher that removes
+	// them on disconnect has stopped.
+	notify    bool
+	watchDone chan struct{}
+	// confirm agents receive the client identity and accept or refuse it.
+	confirm bool
+	// control agents stay registered; wmu serializes the PAIR messages sent
+	// to them.
+	control bool
+	wmu     sync.Mutex
+	// meta is the metadata the agent reported, unescaped, as of registered.
+	meta       map[string]string
+	registered time.Time
+}
 
-// New initializes a new Server.
-func New(opts Options) *Server {
-	return &Server{opts: opts, agents: make(map[string]*stream.BufferedConn)}
+// New initializes a new Server, loading opts.ConfigPath when set.
+func New(opts Options) (*Server, error) {
+	s := &Server{
+		opts:    opts,
+		log:     logging.Component("server"),
+		agents:  make(map[string]*agentConn),
+		waiters: make(map[string]*waiters),
+		pending: make(map[string]*pendingSession),
+		audit:   audit.New(),
+	}
+	cfg := &Config{}
+	if opts.ConfigPath != "" {
+		var err error
+		if cfg, err = LoadConfig(opts.ConfigPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.checkAddress(cfg); err != nil {
+		return nil, err
+	}
+	if err := s.applyLogging(cfg); err != nil {
+		return nil, err
+	}
+	if err := s.audit.Configure(cfg.Audit); err != nil {
+		return nil, err
+	}
+	s.cfg.Store(cfg)
+	return s, nil
 }
 
-// Run starts accepting incoming connections until the context is canceled.
-func (s *Server) Run(ctx context.Context) error {
-	addr := fmt.Sprintf("%s:%d", s.opts.Host, s.opts.Port)
-	listener, err := net.Listen("tcp", addr)
+// Reload reads the config file again. Tokens and limits apply to subsequent
+// handshakes, listeners are opened or closed to match, and established pipes
+// are left alone. An invalid file leaves the previous config in effect;
+// listeners that fail to open are reported in the returned error.
+func (s *Server) Reload() error {
+	if s.opts.ConfigPath == "" {
+		return nil
+	}
+	cfg, err := LoadConfig(s.opts.ConfigPath)
 	if err != nil {
 		return err
 	}
-	log.Printf("[server] listening on %s", addr)
-
-	defer listener.Close()
+	if err := s.checkAddress(cfg); err != nil {
+		return err
+	}
+	if err := s.applyLogging(cfg); err != nil {
+		return err
+	}
+	if err := s.audit.Configure(cfg.Audit); err != nil {
+		return err
+	}
+	s.cfg.Store(cfg)
+	return s.syncListeners(cfg)
+}
 
-	go func() {
-		<-ctx.Done()
-		listener.Close()
-	}()
+// Run starts accepting incoming connections until the context is canceled.
+func (s *Server) Run(ctx context.Context) error {
+	s.lmu.Lock()
+	s.listeners = make(map[string]*listener)
+	s.lmu.Unlock()
+	defer s.closeListeners()
+	defer s.audit.Close()
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			select {
-			case <-ctx.Done():
-				return nil
-			default:
-				log.Printf("[server] accept error: %v", err)
-			}
-			continue
-		}
-		go s.handleConn(conn)
+	if err := s.syncListeners(s.cfg.Load()); err != nil {
+		return err
 	}
+	<-ctx.Done()
+	return nil
+}
+
+// handshake is the state of one incoming connection while it is handled.
+type handshake struct {
+	cfg     *Config
+	conn    *stream.BufferedConn
+	version int
+	peer    identity
+	log     *slog.Logger
+	// ev is the audit record, filled in as the handshake progresses.
+	ev audit.Event
+	// addrs are the peer's candidates for a direct connection, the observed
+	// address first; nil unless it asked for one.
+	addrs []string
+}
+
+// reply answers the handshake with OK in its protocol version.
+func (h *handshake) reply(fields map[string]string, caps []string) error {
+	_, err := h.conn.Write([]byte(protocol.Reply{Version: h.version, Fields: fields, Caps: caps}.Encode()))
+	return err
 }
 
 func (s *Server) handleConn(raw net.Conn) {
+	cfg := s.cfg.Load()
 	reader := bufio.NewReader(raw)
-	raw.SetReadDeadline(time.Now().Add(30 * time.Second))
-	line, err := reader.ReadString('\n')
+	hs := &handshake{
+		cfg:  cfg,
+		conn: stream.Wrap(raw, reader),
+		ev:   audit.Event{RemoteAddr: raw.RemoteAddr().String()},
+	}
+	hs.log = s.log.With(logging.KeyRemoteAddr, hs.ev.RemoteAddr)
+
+	raw.SetReadDeadline(time.Now().Add(cfg.handshakeTimeout()))
+	header, err := protocol.ReadHeader(reader)
+	raw.SetReadDeadline(time.Time{})
+	hs.version = header.Version
 	if err != nil {
-		log.Printf("[server] failed reading header: %v", err)
-		raw.Close()
+		var reason string
+		switch {
+		case errors.Is(err, protocol.ErrUnsupportedVersion):
+			reason = "unsupported protocol version"
+		case header.Version == 0 && (errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded)):
+			hs.log.Warn("failed reading header", logging.Err(err))
+			hs.ev.Kind, hs.ev.Reason = audit.KindRejected, "no header"
+			s.audit.Log(hs.ev)
+			raw.Close()
+			return
+		default:
+			reason = "invalid header"
+		}
+		hs.log.Warn(reason, logging.Err(err))
+		s.reject(hs, reason)
 		return
 	}
-	raw.SetReadDeadline(time.Time{})
-
-	parts := strings.Fields(strings.TrimSpace(line))
-	if len(parts) != 2 {
-		log.Printf("[server] invalid header: %q", line)
-		raw.Write([]byte("ERROR: invalid header\n"))
-		raw.Close()
+	hs.ev.Type, hs.ev.Node = header.Type, header.NodeID
+	hs.log = hs.log.With("type", header.Type, "protocol", header.Version)
+	if header.Has(protocol.CapDirect) && !cfg.RelayOnly {
+		hs.addrs = append([]string{hs.ev.RemoteAddr}, protocol.ParseAddrs(header.Field(protocol.FieldAddrs))...)
+	}
+	token, err := cfg.authenticate(header.Field(protocol.FieldToken))
+	if err != nil {
+		hs.log.Warn("invalid token")
+		s.reject(hs, "unauthorized")
+		return
+	}
+	hs.peer = newIdentity(token, raw)
+	hs.ev = hs.peer.event(hs.ev)
+	hs.log = hs.log.With(hs.peer.logAttrs()...)
+	if header.Type == protocol.TypeList {
+		s.listNodes(hs, header.Has(protocol.CapMeta))
+		hs.log.Debug("listed nodes")
 		return
 	}
 
-	typ := strings.ToUpper(parts[0])
-	nodeID := parts[1]
-	if !nodeIDPattern.MatchString(nodeID) {
-		log.Printf("[server] invalid node-id format: %s", nodeID)
-		raw.Write([]byte("ERROR: invalid node-id\n"))
-		raw.Close()
+	nodeID := header.NodeID
+	if !protocol.NamePattern.MatchString(nodeID) {
+		hs.log.Warn("invalid node-id", logging.KeyNodeID, nodeID)
+		s.reject(hs, "invalid node-id")
+		return
+	}
+	service := header.Field(protocol.FieldService)
+	if service != "" && !protocol.NamePattern.MatchString(service) {
+		hs.log.Warn("invalid service", logging.KeyNodeID, nodeID, logging.KeyService, service)
+		s.reject(hs, "invalid service")
 		return
 	}
-	conn := stream.Wrap(raw, reader)
+	key := agentKey(nodeID, service)
+	hs.ev.Node = key
+	hs.log = hs.log.With(logging.KeyNodeID, nodeID)
+	if service != "" {
+		hs.log = hs.log.With(logging.KeyService, service)
+	}
 
-	switch typ {
-	case "AGENT":
-		s.registerAgent(conn, nodeID)
-	case "CLIENT":
-		s.handleClient(conn, nodeID)
+	switch header.Type {
+	case protocol.TypeAgent:
+		s.registerAgent(hs, header, key)
+	case protocol.TypeClient:
+		s.handleClient(hs, header, nodeID, key)
+	case protocol.TypeData:
+		s.acceptData(hs, header, key)
 	default:
-		log.Printf("[server] unknown type %q", typ)
-		raw.Write([]byte("ERROR: unknown type\n"))
-		raw.Close()
+		hs.log.Warn("unknown handshake type")
+		s.reject(hs, "unknown type")
+	}
+}
+
+// reject answers a handshake with an error, records it in the audit trail
+// and closes the connection.
+func (s *Server) reject(hs *handshake, reason string) {
+	ev := hs.ev
+	ev.Kind, ev.Reason = audit.KindRejected, reason
+	s.audit.Log(ev)
+	hs.conn.Write([]byte(protocol.ErrorReply(hs.version, reason)))
+	hs.conn.Close()
+}
+
+// agentKey identifies a registration: the node-id alone for the default
+// service, or node-id/service for additional services on the same node.
+func agentKey(nodeID, service string) string {
+	if service == "" {
+		return nodeID
 	}
+	return nodeID + "/" + service
 }
 
-func (s *Server) registerAgent(conn *stream.BufferedConn, nodeID string) {
+// nodeIDOf returns the node-id part of an agent key.
+func nodeIDOf(key string) string {
+	nodeID, _, _ := strings.Cut(key, "/")
+	return nodeID
+}
+
+func (s *Server) registerAgent(hs *handshake, header protocol.Header, nodeID string) {
+	notify := header.Has(protocol.CapPair)
+	confirm := notify && header.Has(protocol.CapConfirm)
+	control := notify && hs.version >= protocol.Version2 && header.Has(protocol.CapControl)
+	agent := &agentConn{
+		conn:       hs.conn,
+		log:        hs.log,
+		version:    hs.version,
+		peer:       hs.peer,
+		notify:     notify,
+		confirm:    confirm,
+		control:    control,
+		meta:       map[string]string{},
+		registered: time.Now(),
+	}
+	for _, field := range protocol.MetaFields {
+		if value := header.Field(field); value != "" {
+			agent.meta[field] = protocol.UnescapeValue(value)
+		}
+	}
+	// Tags are relayed to LIST clients as is; refuse any they cannot parse.
+	if _, err := protocol.ParseTags(agent.meta[protocol.FieldTags]); err != nil {
+		hs.log.Warn("rejecting agent: invalid tags", logging.Err(err))
+		s.reject(hs, "invalid tags: "+err.Error())
+		return
+	}
+	if !hs.cfg.authorize(hs.peer, roleAgent, header.NodeID) {
+		hs.log.Warn("rejecting agent: forbidden by ACL")
+		s.reject(hs, "forbidden")
+		return
+	}
+	if reason := s.admitAgent(hs, nodeID); reason != "" {
+		s.reject(hs, reason)
+		return
+	}
+
+	var caps []string
+	if notify {
+		caps = append(caps, protocol.CapPair)
+		if confirm {
+			caps = append(caps, protocol.CapConfirm)
+		}
+		if control {
+			caps = append(caps, protocol.CapControl)
+		}
+	}
+	// The agent only becomes visible once it has its OK, so a client paired
+	// with it right away cannot have its PAIR written ahead of the reply.
+	hs.conn.SetWriteDeadline(time.Now().Add(hs.cfg.handshakeTimeout()))
+	err := hs.reply(nil, caps)
+	hs.conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		hs.log.Warn("agent registration failed", logging.Err(err))
+		hs.conn.Close()
+		return
+	}
+
+	if notify && !control {
+		// Set before the agent is visible so a client that claims it waits
+		// for watchAgent to stop reading.
+		agent.watchDone = make(chan struct{})
+	}
 	s.mu.Lock()
+	// Checked again: another agent may have registered while the reply was
+	// written.
 	if _, exists := s.agents[nodeID]; exists {
 		s.mu.Unlock()
-		log.Printf("[server] agent collision for node %s", nodeID)
-		conn.Write([]byte("ERROR: node-id already registered\n"))
-		conn.Close()
+		hs.log.Warn("dropping agent: node-id already registered")
+		hs.conn.Close()
 		return
 	}
-	s.agents[nodeID] = conn
+	s.agents[nodeID] = agent
 	total := len(s.agents)
 	s.mu.Unlock()
 
-	log.Printf("[server] agent connected: %s (total: %d)", nodeID, total)
-	conn.Write([]byte("OK\n"))
+	hs.log.Info("agent connected", "agents", total)
+	switch {
+	case control:
+		go s.serveControl(nodeID, agent)
+	case notify:
+		go s.watchAgent(nodeID, agent)
+	}
+	s.wakeWaiters(nodeID)
 }
 
-func (s *Server) handleClient(conn *stream.BufferedConn, nodeID string) {
-	agentConn := s.popAgent(nodeID)
-	if agentConn == nil {
-		conn.Write([]byte("ERROR: agent offline\n"))
-		conn.Close()
-		return
+// admitAgent checks the agent limit and that nodeID is free. It returns the
+// reason to reject the agent with, or "".
+func (s *Server) admitAgent(hs *handshake, nodeID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if max := hs.cfg.Limits.MaxAgents; max > 0 && len(s.agents) >= max {
+		hs.log.Warn("rejecting agent: agent limit reached", "max_agents", max)
+		return "too many agents"
 	}
+	if _, exists := s.agents[nodeID]; exists {
+		hs.log.Warn("rejecting agent: node-id already registered")
+		return "node-id already registered"
+	}
+	return ""
+}
 
-	log.Printf("[server] pairing client with %s", nodeID)
-	conn.Write([]byte("OK\n"))
-	stream.Pipe(agentConn, conn)
-	log.Printf("[server] connection closed: %s", nodeID)
+// waiters are the clients waiting for one agent key; registered is closed
+// when an agent registers under it.
+type waiters struct {
+	registered chan struct{}
+	count      int
 }
 
-func (s *Server) popAgent(nodeID string) *stream.BufferedConn {
+// wakeWaiters signals the clients waiting for an agent under key.
+func (s *Server) wakeWaiters(key string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	agent, ok := s.agents[nodeID]
-	if !ok {
+	if w, ok := s.waiters[key]; ok {
+		close(w.registered)
+		delete(s.waiters, key)
+	}
+	s.mu.Unlock()
+}
+
+// watchAgent removes an idle agent as soon as its connection closes, so a
+// restarted or reloaded agent can register again under the same node-id.
+func (s *Server) watchAgent(nodeID string, agent *agentConn) {
+	defer close(agent.watchDone)
+	_, err := agent.conn.Peek(1)
+
+	s.mu.Lock()
+	current := s.agents[nodeID] == agent
+	if current {
+		delete(s.agents, nodeID)
+	}
+	s.mu.Unlock()
+	if current {
+		agent.log.Info("agent disconnected while idle", logging.Err(err))
+		agent.conn.Close()
+	}
+}
+
+var errRefused = errors.New("refused by agent")
+
+// pairHeader is the PAIR message for session, carrying the client identity
+// for confirming agents. direct tells the agent that the client asked for a
+// direct connection, so it is worth preparing one.
+func (a *agentConn) pairHeader(peer identity, session string, direct bool) protocol.Header {
+	header := protocol.Header{Version: a.version, Type: protocol.TypePair, Fields: map[string]string{}}
+	if a.confirm {
+		header.Fields = peer.fields()
+	}
+	header.Fields[protocol.FieldSession] = session
+	if direct {
+		header.Caps = []string{protocol.CapDirect}
+	}
+	return header
+}
+
+// pair sends the PAIR message for session. Confirming agents must accept the
+// client before the pipe starts.
+func (a *agentConn) pair(cfg *Config, peer identity, session string) error {
+	header := a.pairHeader(peer, session, false)
+	if _, err := a.conn.Write([]byte(header.Encode())); err != nil {
+		return err
+	}
+	if !a.confirm {
 		return nil
 	}
-	delete(s.agents, nodeID)
-	return agent
+	a.conn.SetReadDeadline(time.Now().Add(cfg.handshakeTimeout()))
+	_, err := protocol.ReadReply(a.conn)
+	a.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		var remote *protocol.RemoteError
+		if errors.As(err, &remote) {
+			return fmt.Errorf("%w: %v", errRefused, err)
+		}
+		return fmt.Errorf("wait for agent confirmation: %w", err)
+	}
+	return nil
+}
+
+// claim stops the idle watcher of an agent taken out of the map.
+func (a *agentConn) claim() {
+	if a.watchDone == nil {
+		return
+	}
+	a.conn.SetReadDeadline(time.Now())
+	<-a.watchDone
+	a.conn.SetReadDeadline(time.Time{})
+}
+
+// handleClient pairs a client with the agent registered under key, which
+// belongs to nodeID. A client that asked to wait is held until the agent
+// registers; it only takes a session slot once the agent is there.
+func (s *Server) handleClient(hs *handshake, header protocol.Header, nodeID, key string) {
+	hs.ev.Session = newSessionID()
+	hs.log = hs.log.With(logging.KeySessionID, hs.ev.Session)
+	var wait time.Duration
+	if value := header.Field(protocol.FieldWait); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			hs.log.Warn("invalid wait", "wait", value)
+			s.reject(hs, "invalid wait")
+			return
+		}
+		wait = hs.cfg.clientWait(time.Duration(seconds) * time.Second)
+	}
+	if !hs.cfg.authorize(hs.peer, roleClient, nodeID) {
+		hs.log.Warn("forbidden by ACL")
+		s.reject(hs, "forbidden")
+		return
+	}
+	deadline := time.Now().Add(wait)
+	var (
+		peer      *stream.BufferedConn
+		peerAddrs []string
+	)
+	for peer == nil {
+		agent, err := s.waitAgent(hs, key, deadline)
+		if errors.Is(err, errSessionLimit) {
+			hs.log.Warn("rejecting client: session limit reached", "max_sessions", hs.cfg.Limits.MaxSessions)
+			s.reject(hs, "too many sessions")
+			return
+		}
+		if err != nil {
+			hs.log.Info("rejecting client: agent offline")
+			s.reject(hs, "agent offline")
+			return
+		}
+		hs.log.Info("pairing client")
+		if peer, peerAddrs, err = s.connectAgent(hs, key, agent); err != nil {
+			s.endSession()
+			hs.log.Warn("pairing failed", logging.Err(err))
+			if errors.Is(err, errRefused) {
+				s.reject(hs, "refused by agent")
+				return
+			}
+			if errors.Is(err, errNoDataConn) {
+				s.reject(hs, "agent not responding")
+				return
+			}
+			// A stale registration; the agent may be back shortly.
+		}
+	}
+	defer s.endSession()
+	fields := map[string]string{protocol.FieldSession: hs.ev.Session}
+	var caps []string
+	if peerAddrs != nil {
+		fields[protocol.FieldPeerAddrs] = protocol.FormatAddrs(peerAddrs)
+		caps = []string{protocol.CapDirect}
+		hs.log.Info("offering direct connection")
+	}
+	hs.reply(fields, caps)
+	if peerAddrs != nil {
+		hs.ev.Direct = forwardPath(hs, peer)
+	}
+	ev := hs.ev
+	ev.Start = time.Now().UTC()
+	stats := stream.Pipe(peer, hs.conn)
+
+	ev.Kind = audit.KindSession
+	ev.DurationMS = time.Since(ev.Start).Milliseconds()
+	ev.BytesIn, ev.BytesOut = stats.BToA, stats.AToB
+	switch {
+	case stats.Err != nil:
+		ev.End, ev.Reason = "error", stats.Err.Error()
+	case stats.ClosedByB:
+		ev.End = "client_closed"
+	default:
+		ev.End = "agent_closed"
+	}
+	s.audit.Log(ev)
+	hs.log.Info("connection closed", "end", ev.End, "duration_ms", ev.DurationMS, "bytes_in", ev.BytesIn, "bytes_out", ev.BytesOut)
+}
+
+// forwardPath passes the client's choice between a direct connection and
+// the relay on to the agent, and reports whether the session went direct.
+func forwardPath(hs *handshake, peer io.Writer) bool {
+	// The agent waits as long for the decision before giving up.
+	hs.conn.SetReadDeadline(time.Now().Add(2 * punch.Timeout))
+	line, err := hs.conn.ReadString('\n')
+	hs.conn.SetReadDeadline(time.Time{})
+	if err == nil {
+		_, err = io.WriteString(peer, line)
+	}
+	if err != nil {
+		hs.log.Warn("no connection path from client", logging.Err(err))
+		hs.conn.Close()
+		return false
+	}
+	direct := strings.TrimSpace(line) == protocol.DirectChosen
+	if direct {
+		hs.log.Info("client connected directly to agent")
+	}
+	return direct
+}
+
+// connectAgent returns the agent side of the client's session: a fresh data
+// connection from a control agent, or else the registration itself. The
+// agent's direct connection candidates are returned when both sides asked
+// for one. A control agent is dropped when its channel fails or the ACL no
+// longer allows it; a refusal or a missing data connection only fails the
+// session. A plain registration that fails is always closed.
+func (s *Server) connectAgent(hs *handshake, key string, agent *agentConn) (*stream.BufferedConn, []string, error) {
+	if agent.control {
+		r := s.openSession(hs, agent)
+		if r.err != nil && !errors.Is(r.err, errRefused) && !errors.Is(r.err, errNoDataConn) {
+			s.dropAgent(key, agent)
+		}
+		return r.conn, r.peerAddrs, r.err
+	}
+	if agent.notify {
+		if err := agent.pair(hs.cfg, hs.peer, hs.ev.Session); err != nil {
+			agent.conn.Close()
+			return nil, nil, err
+		}
+	}
+	return agent.conn, nil, nil
+}
+
+// newSessionID returns a random identifier for one client connection.
+func newSessionID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// startSession reserves a slot under the session limit. s.mu must be held.
+func (s *Server) startSession(cfg *Config) bool {
+	if max := cfg.Limits.MaxSessions; max > 0 && s.sessions >= max {
+		return false
+	}
+	s.sessions++
+	return true
+}
+
+func (s *Server) endSession() {
+	s.mu.Lock()
+	s.sessions--
+	s.mu.Unlock()
+}
+
+// listNodes writes the keys of all registered agents (see agentKey) that the
+// peer may reach, one per line, after an OK. With withMeta each line also
+// carries the agent's metadata.
+func (s *Server) listNodes(hs *handshake, withMeta bool) {
+	defer hs.conn.Close()
+
+	s.mu.Lock()
+	lines := make([]string, 0, len(s.agents))
+	for key, agent := range s.agents {
+		// Only nodes the peer may both list and reach are shown.
+		if !hs.cfg.authorize(hs.peer, roleList, nodeIDOf(key)) || !hs.cfg.authorize(hs.peer, roleClient, nodeIDOf(key)) {
+			continue
+		}
+		if withMeta {
+			lines = append(lines, protocol.NodeLine(key, agent.currentMeta()))
+		} else {
+			lines = append(lines, key)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(lines)
+
+	var caps []string
+	if withMeta {
+		caps = []string{protocol.CapMeta}
+	}
+	var b strings.Builder
+	b.WriteString(protocol.Reply{Version: hs.version, Caps: caps}.Encode())
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	hs.conn.Write([]byte(b.String()))
+}
+
+// currentMeta returns the agent metadata with the uptime brought up to date.
+func (a *agentConn) currentMeta() map[string]string {
+	meta := make(map[string]string, len(a.meta))
+	for key, value := range a.meta {
+		meta[key] = value
+	}
+	if uptime, err := strconv.ParseInt(meta[protocol.FieldUptime], 10, 64); err == nil {
+		uptime += int64(time.Since(a.registered).Seconds())
+		meta[protocol.FieldUptime] = strconv.FormatInt(uptime, 10)
+	}
+	return meta
+}
+
+var (
+	errAgentOffline = errors.New("agent offline")
+	errSessionLimit = errors.New("too many sessions")
+)
+
+// waitAgent takes the agent registered under key out of the map; control
+// agents are left in place since they serve any number of sessions. If there
+// is none it waits for one to register until deadline, giving up early when the
+// client hangs up. A session slot is reserved along with the agent; the
+// caller releases it with endSession.
+func (s *Server) waitAgent(hs *handshake, key string, deadline time.Time) (*agentConn, error) {
+	var (
+		timer   *time.Timer
+		hangup  <-chan struct{}
+		unwatch func()
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		if unwatch != nil {
+			unwatch()
+		}
+	}()
+	for {
+		s.mu.Lock()
+		agent, ok := s.agents[key]
+		if ok && !s.startSession(hs.cfg) {
+			s.mu.Unlock()
+			return nil, errSessionLimit
+		}
+		if ok && agent.control {
+			s.mu.Unlock()
+			return agent, nil
+		}
+		if ok {
+			delete(s.agents, key)
+			s.mu.Unlock()
+			agent.claim()
+			return agent, nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			s.mu.Unlock()
+			return nil, errAgentOffline
+		}
+		w, ok := s.waiters[key]
+		if !ok {
+			w = &waiters{registered: make(chan struct{})}
+			s.waiters[key] = w
+		}
+		w.count++
+		s.mu.Unlock()
+
+		if timer == nil {
+			hs.log.Info("waiting for agent", "wait", remaining.Round(time.Second).String())
+			timer = time.NewTimer(remaining)
+			hangup, unwatch = watchHangup(hs.conn)
+		}
+		select {
+		case <-w.registered:
+		case <-timer.C:
+			s.leaveWaiters(key, w)
+			return nil, errAgentOffline
+		case <-hangup:
+			s.leaveWaiters(key, w)
+			hs.log.Info("client left while waiting for agent")
+			return nil, errAgentOffline
+		}
+	}
+}
+
+// leaveWaiters drops a client that stopped waiting for key, removing the
+// entry once nobody waits for it.
+func (s *Server) leaveWaiters(key string, w *waiters) {
+	s.mu.Lock()
+	if w.count--; w.count == 0 && s.waiters[key] == w {
+		delete(s.waiters, key)
+	}
+	s.mu.Unlock()
+}
+
+// watchHangup returns a channel closed when the peer closes conn while it is
+// expected to stay silent, and a func that ends the watch.
+func watchHangup(conn *stream.BufferedConn) (<-chan struct{}, func()) {
+	hangup := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := conn.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			close(hangup)
+		}
+	}()
+	return hangup, func() {
+		conn.SetReadDeadline(time.Now())
+		<-done
+		conn.SetReadDeadline(time.Time{})
+	}
 }
@@ -0,0 +1,125 @@
+package sshconfig
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Markers delimiting the block of Host stanzas that mssh owns in a config file.
+const (
+	BeginMarker = "# BEGIN mssh managed hosts (generated by 'mssh config ssh-config'; do not edit)"
+	EndMarker   = "# END mssh managed hosts"
+)
+
+// ErrUnterminatedBlock is returned when a managed block has no end marker,
+// so it is unclear which lines mssh owns.
+var ErrUnterminatedBlock = errors.New("managed block has no end marker; remove its begin marker or restore " + EndMarker)
+
+// ReplaceManagedBlock returns existing with the managed block replaced by
+// block. ssh_config uses the first value it finds, so the block goes before
+// the first Host or Match line, where it is not overridden by stanzas such
+// as "Host *"; an existing block further down is moved there.
+func ReplaceManagedBlock(existing, block string) (string, error) {
+	managed := BeginMarker + "\n" + strings.TrimRight(block, "\n") + "\n" + EndMarker + "\n"
+
+	start := strings.Index(existing, BeginMarker)
+	if start >= 0 {
+		end := strings.Index(existing[start:], EndMarker)
+		if end < 0 {
+			return "", ErrUnterminatedBlock
+		}
+		before := existing[:start]
+		after := strings.TrimPrefix(existing[start+end+len(EndMarker):], "\n")
+		if firstStanza(before) < 0 {
+			return before + managed + after, nil
+		}
+		// Drop the block and the blank line that set it apart.
+		existing = strings.TrimSuffix(before, "\n") + after
+	}
+
+	at := firstStanza(existing)
+	if at < 0 {
+		if existing == "" {
+			return managed, nil
+		}
+		if !strings.HasSuffix(existing, "\n") {
+			existing += "\n"
+		}
+		return existing + "\n" + managed, nil
+	}
+	return existing[:at] + managed + "\n" + existing[at:], nil
+}
+
+// firstStanza returns the offset of the first Host or Match line in config,
+// moved up over the comment lines right above it, or -1 if there is none.
+func firstStanza(config string) int {
+	offset, comments := 0, -1
+	for _, line := range strings.SplitAfter(config, "\n") {
+		trimmed := strings.TrimSpace(line)
+		key, _, _ := splitLine(line)
+		switch {
+		case key == "host" || key == "match":
+			if comments >= 0 {
+				return comments
+			}
+			return offset
+		case strings.HasPrefix(trimmed, "#"):
+			if comments < 0 {
+				comments = offset
+			}
+		default:
+			comments = -1
+		}
+		offset += len(line)
+	}
+	return -1
+}
+
+// WriteManagedBlock updates the managed block in the file at path, creating
+// the file (and its directory) if needed. It reports whether the file changed.
+func WriteManagedBlock(path, block string) (bool, error) {
+	// Write through symlinks (e.g. dotfile managers) instead of replacing them.
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	updated, err := ReplaceManagedBlock(string(data), block)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	if updated == string(data) {
+		return false, nil
+	}
+
+	mode := os.FileMode(0o600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return false, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".mssh-ssh-config-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(updated); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
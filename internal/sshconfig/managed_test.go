@@ -0,0 +1,82 @@
+package sshconfig
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReplaceManagedBlock(t *testing.T) {
+	const block = "Host web-1\n  ProxyCommand mssh proxy web-1\n"
+	managed := BeginMarker + "\n" + block + EndMarker + "\n"
+	old := BeginMarker + "\nHost old\n" + EndMarker + "\n"
+
+	tests := []struct {
+		name     string
+		existing string
+		want     string
+		wantErr  error
+	}{
+		{
+			name: "empty file",
+			want: managed,
+		},
+		{
+			name:     "no trailing newline and no hosts",
+			existing: "User alice",
+			want:     "User alice\n\n" + managed,
+		},
+		{
+			name:     "before the first host",
+			existing: "User alice\n\nHost *\n  ForwardAgent no\n",
+			want:     "User alice\n\n" + managed + "\nHost *\n  ForwardAgent no\n",
+		},
+		{
+			name:     "before a match line",
+			existing: "Match all\n  User bob",
+			want:     managed + "\nMatch all\n  User bob",
+		},
+		{
+			name:     "comments stay with their host",
+			existing: "User alice\n\n# everything\n# else\nHost *\n",
+			want:     "User alice\n\n" + managed + "\n# everything\n# else\nHost *\n",
+		},
+		{
+			name:     "replace existing block in place",
+			existing: "User alice\n\n" + old + "\nHost *\n  User bob\n",
+			want:     "User alice\n\n" + managed + "\nHost *\n  User bob\n",
+		},
+		{
+			name:     "replace block at the end of a file without hosts",
+			existing: "User alice\n\n" + old,
+			want:     "User alice\n\n" + managed,
+		},
+		{
+			name:     "move block appended after host *",
+			existing: "Host *\n  User bob\n\n" + old,
+			want:     managed + "\nHost *\n  User bob\n",
+		},
+		{
+			name:     "missing end marker",
+			existing: "Host *\n" + BeginMarker + "\nHost old\n",
+			wantErr:  ErrUnterminatedBlock,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReplaceManagedBlock(tt.existing, block)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got != tt.want {
+				t.Fatalf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+			// Running again must not change the file.
+			if again, err := ReplaceManagedBlock(got, block); err != nil || again != got {
+				t.Errorf("second run changed the file:\n%s", again)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+// Package sshconfig reads the subset of OpenSSH client configuration that the
+// built-in mssh client understands.
+package sshconfig
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxIncludeDepth matches the recursion limit used by OpenSSH.
+const maxIncludeDepth = 16
+
+// Config holds the parsed directives of an ssh_config file in file order.
+type Config struct {
+	entries []entry
+}
+
+type entry struct {
+	// patterns are the Host patterns of the enclosing block; nil means the
+	// directive appeared before any Host line and applies to every host.
+	patterns []string
+	// never is set for directives inside Match blocks, which are not supported.
+	never  bool
+	key    string
+	values []string
+}
+
+// DefaultPath returns ~/.ssh/config.
+func DefaultPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".ssh", "config"), nil
+}
+
+// Load parses the file at path, following Include directives. A missing
+// file yields an empty Config.
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+	p := parser{cfg: cfg}
+	if err := p.parseFile(path, block{}, 0); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Get returns the first value configured for key on host, as OpenSSH does.
+func (c *Config) Get(host, key string) string {
+	key = strings.ToLower(key)
+	for _, e := range c.entries {
+		if e.key == key && e.matches(host) {
+			return strings.Join(e.values, " ")
+		}
+	}
+	return ""
+}
+
+// GetAll returns every value configured for key on host, for directives such
+// as IdentityFile and LocalForward that accumulate.
+func (c *Config) GetAll(host, key string) []string {
+	key = strings.ToLower(key)
+	var values []string
+	for _, e := range c.entries {
+		if e.key == key && e.matches(host) {
+			values = append(values, strings.Join(e.values, " "))
+		}
+	}
+	return values
+}
+
+func (e entry) matches(host string) bool {
+	if e.never {
+		return false
+	}
+	if e.patterns == nil {
+		return true
+	}
+	return MatchPatterns(e.patterns, host)
+}
+
+// MatchPatterns reports whether host matches a list of Host patterns. A
+// negated pattern (prefixed with "!") that matches rejects the host outright.
+// Host names are case-insensitive, as in OpenSSH.
+func MatchPatterns(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+	matched := false
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.ToLower(strings.TrimPrefix(pattern, "!"))
+		if matchPattern(pattern, host) {
+			if negate {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchPattern reports whether s matches pattern, where '*' matches any
+// run of characters and '?' any single one. Unlike filepath.Match there are
+// no character classes or escapes, as in OpenSSH.
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+			_, size := utf8.DecodeRuneInString(s)
+			pattern, s = pattern[1:], s[size:]
+		default:
+			if s == "" || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return s == ""
+}
+
+type block struct {
+	patterns []string
+	never    bool
+}
+
+type parser struct {
+	cfg *Config
+}
+
+func (p *parser) parseFile(path string, current block, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: include nested too deeply", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		key, values, err := splitLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		if key == "" {
+			continue
+		}
+
+		switch key {
+		case "host":
+			current = block{patterns: values}
+		case "match":
+			// Only "Match all" is understood; other criteria never match.
+			if len(values) == 1 && strings.EqualFold(values[0], "all") {
+				current = block{patterns: []string{"*"}}
+			} else {
+				current = block{never: true}
+			}
+		case "include":
+			for _, pattern := range values {
+				if err := p.include(pattern, current, depth); err != nil {
+					return fmt.Errorf("%s:%d: %w", path, lineNo, err)
+				}
+			}
+		default:
+			p.cfg.entries = append(p.cfg.entries, entry{
+				patterns: current.patterns,
+				never:    current.never,
+				key:      key,
+				values:   values,
+			})
+		}
+	}
+	return scanner.Err()
+}
+
+func (p *parser) include(pattern string, current block, depth int) error {
+	pattern = ExpandHome(pattern)
+	if !filepath.IsAbs(pattern) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		pattern = filepath.Join(home, ".ssh", pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		// Host/Match lines inside an included file only last until its end.
+		if err := p.parseFile(match, current, depth+1); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitLine returns the lowercased keyword and its arguments. Keywords may
+// be separated from their arguments by whitespace or a single "=".
+func splitLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	key := strings.ToLower(line[:end])
+	rest := strings.TrimSpace(line[end:])
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+
+	values, err := splitArgs(rest)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, values, nil
+}
+
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inQuote := false
+	hasToken := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			hasToken = true
+		case !inQuote && (r == ' ' || r == '\t'):
+			if hasToken {
+				args = append(args, current.String())
+				current.Reset()
+				hasToken = false
+			}
+		case !inQuote && r == '#':
+			if hasToken {
+				args = append(args, current.String())
+			}
+			return args, nil
+		default:
+			current.WriteRune(r)
+			hasToken = true
+		}
+	}
+	if inQuote {
+		return nil, errors.New("unterminated quote")
+	}
+	if hasToken {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// ExpandHome replaces a leading "~" with the user's home directory.
+func ExpandHome(path string) string {
+	if !strings.HasPrefix(path, "~") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
@@ -0,0 +1,204 @@
+package sshconfig
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		host     string
+		want     bool
+	}{
+		{[]string{"*"}, "web-1", true},
+		{[]string{"web-*"}, "web-1", true},
+		{[]string{"web-*"}, "db-1", false},
+		{[]string{"web-?"}, "web-1", true},
+		{[]string{"web-?"}, "web-10", false},
+		{[]string{"*.example.com"}, "a.b.example.com", true},
+		{[]string{"*-*-prod"}, "eu-web-prod", true},
+		{[]string{"WEB-*"}, "web-1", true},
+		{[]string{"web-*"}, "WEB-1", true},
+		{[]string{"db-*", "web-*"}, "web-1", true},
+		{[]string{"web-*", "!web-2"}, "web-2", false},
+		{[]string{"!web-2", "web-*"}, "web-2", false},
+		{[]string{"!web-2"}, "web-1", false},
+		{nil, "web-1", false},
+		// Only '*' and '?' are special; classes and escapes are literal.
+		{[]string{"web-[12]"}, "web-1", false},
+		{[]string{"web-[12]"}, "web-[12]", true},
+		{[]string{`web\-1`}, "web-1", false},
+		{[]string{`web\*`}, `web\x`, true},
+	}
+	for _, tt := range tests {
+		if got := MatchPatterns(tt.patterns, tt.host); got != tt.want {
+			t.Errorf("MatchPatterns(%q, %q) = %v, want %v", tt.patterns, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		key     string
+		values  []string
+		wantErr bool
+	}{
+		{"", "", nil, false},
+		{"  # comment", "", nil, false},
+		{"User alice", "user", []string{"alice"}, false},
+		{"user\talice", "user", []string{"alice"}, false},
+		{"User=alice", "user", []string{"alice"}, false},
+		{"User = alice", "user", []string{"alice"}, false},
+		{"IdentityFile \"~/my keys/id\"", "identityfile", []string{"~/my keys/id"}, false},
+		{"Host web-* db-*  # prod", "host", []string{"web-*", "db-*"}, false},
+		{"LocalForward 8080 localhost:80", "localforward", []string{"8080", "localhost:80"}, false},
+		{"Compression", "compression", nil, false},
+		{"User \"alice", "", nil, true},
+	}
+	for _, tt := range tests {
+		key, values, err := splitLine(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitLine(%q) err = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if key != tt.key || !reflect.DeepEqual(values, tt.values) {
+			t.Errorf("splitLine(%q) = %q, %q, want %q, %q", tt.line, key, values, tt.key, tt.values)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "conf.d", "a.conf"), `
+Host included
+  User from-include
+Port 2200
+`)
+	write(t, filepath.Join(dir, "conf.d", "b.conf"), `
+HostName b.example.com
+`)
+	path := write(t, filepath.Join(dir, "config"), `
+User top
+IdentityFile ~/.ssh/top
+
+Host web-*
+  User web
+  IdentityFile ~/.ssh/web
+  Port=2201
+
+Host web-2
+  User ignored
+  HostName web-2.example.com
+
+Host inc
+  Include `+filepath.Join(dir, "conf.d", "*.conf")+`
+
+Match host prod
+  User never
+
+Match all
+  User fallback
+  StrictHostKeyChecking yes
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host, key string
+		want      string
+	}{
+		// Directives before the first Host apply to every host and win.
+		{"web-1", "user", "top"},
+		{"web-1", "port", "2201"},
+		{"web-2", "hostname", "web-2.example.com"},
+		{"db-1", "port", ""},
+		{"db-1", "stricthostkeychecking", "yes"},
+		{"prod", "stricthostkeychecking", "yes"},
+		// Keys are case-insensitive.
+		{"web-1", "Port", "2201"},
+		// An Include inside a Host block inherits it; Host lines in the
+		// included file only last until its end.
+		{"inc", "port", ""},
+		{"included", "port", "2200"},
+		{"inc", "hostname", "b.example.com"},
+		{"other", "hostname", ""},
+	}
+	for _, tt := range tests {
+		if got := cfg.Get(tt.host, tt.key); got != tt.want {
+			t.Errorf("Get(%q, %q) = %q, want %q", tt.host, tt.key, got, tt.want)
+		}
+	}
+
+	if got, want := cfg.GetAll("web-1", "IdentityFile"), []string{"~/.ssh/top", "~/.ssh/web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetAll(web-1, IdentityFile) = %q, want %q", got, want)
+	}
+	if got := cfg.GetAll("db-1", "identityfile"); !reflect.DeepEqual(got, []string{"~/.ssh/top"}) {
+		t.Errorf("GetAll(db-1, identityfile) = %q", got)
+	}
+}
+
+func TestLoadIncludeScope(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "inc"), "Host included\n  User inner\n")
+	path := write(t, filepath.Join(dir, "config"), "Include "+filepath.Join(dir, "inc")+"\nUser outer\n")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Get("included", "user"); got != "inner" {
+		t.Errorf("included host: user = %q, want inner", got)
+	}
+	// The included Host block ended with its file.
+	if got := cfg.Get("other", "user"); got != "outer" {
+		t.Errorf("other host: user = %q, want outer", got)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	loop := filepath.Join(dir, "loop")
+	write(t, loop, "Include "+loop+"\n")
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr string
+	}{
+		{"missing file", filepath.Join(dir, "missing"), ""},
+		{"missing include", write(t, filepath.Join(dir, "a"), "Include "+filepath.Join(dir, "nope")+"\n"), ""},
+		{"include recursion", loop, "nested too deeply"},
+		{"unterminated quote", write(t, filepath.Join(dir, "b"), "User \"alice\n"), "b:1: unterminated quote"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Load: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func write(t *testing.T, path, data string) string {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -41,6 +41,15 @@ func loadKeyFromPath(path string) ssh.AuthMethod {
 
 // LoadSSHAgent returns an auth method backed by the SSH agent, if available.
 func LoadSSHAgent() (ssh.AuthMethod, func(), error) {
+	agentClient, cleanup, err := DialSSHAgent()
+	if err != nil {
+		return nil, nil, err
+	}
+	return ssh.PublicKeysCallback(agentClient.Signers), cleanup, nil
+}
+
+// DialSSHAgent connects to the agent listening on SSH_AUTH_SOCK.
+func DialSSHAgent() (sshagent.ExtendedAgent, func(), error) {
 	sock := os.Getenv("SSH_AUTH_SOCK")
 	if sock == "" {
 		return nil, nil, fmt.Errorf("SSH_AUTH_SOCK not set")
@@ -51,7 +60,19 @@ func LoadSSHAgent() (ssh.AuthMethod, func(), error) {
 		return nil, nil, err
 	}
 
-	agentClient := sshagent.NewClient(conn)
 	cleanup := func() { conn.Close() }
-	return ssh.PublicKeysCallback(agentClient.Signers), cleanup, nil
+	return sshagent.NewClient(conn), cleanup, nil
+}
+
+// ForwardAgent serves auth-agent@openssh.com channels opened by the remote
+// host from the local SSH agent and requests forwarding on the session.
+func ForwardAgent(client *ssh.Client, session *ssh.Session) error {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return fmt.Errorf("SSH_AUTH_SOCK not set")
+	}
+	if err := sshagent.ForwardToRemote(client, sock); err != nil {
+		return err
+	}
+	return sshagent.RequestAgentForwarding(session)
 }
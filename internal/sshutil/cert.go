@@ -0,0 +1,207 @@
+package sshutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/eznix86/mssh/internal/sshconfig"
+)
+
+// hostCertAlgorithms lists the host key algorithms offered when host
+// certificates are required.
+var hostCertAlgorithms = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01,
+	ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoRSASHA512v01,
+	ssh.CertAlgoRSASHA256v01,
+	ssh.CertAlgoRSAv01,
+}
+
+// LoadCertificate reads the OpenSSH certificate stored next to a private key
+// (for example id_ed25519-cert.pub for id_ed25519).
+func LoadCertificate(keyPath string) (*ssh.Certificate, error) {
+	data, err := os.ReadFile(keyPath + "-cert.pub")
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s-cert.pub is not a certificate", keyPath)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%s-cert.pub is not a user certificate", keyPath)
+	}
+	return cert, nil
+}
+
+// CertSigners pairs each plain signer with any certificate issued for its key.
+// Certificate signers come first so servers see them before the bare keys;
+// signers that already carry a certificate (e.g. from the SSH agent) are kept as is.
+func CertSigners(signers []ssh.Signer, certs []*ssh.Certificate) []ssh.Signer {
+	var withCerts, plain []ssh.Signer
+	for _, signer := range signers {
+		if _, ok := signer.PublicKey().(*ssh.Certificate); ok || isCertType(signer.PublicKey().Type()) {
+			withCerts = append(withCerts, signer)
+			continue
+		}
+		keyBytes := signer.PublicKey().Marshal()
+		for _, cert := range certs {
+			if !bytes.Equal(cert.Key.Marshal(), keyBytes) {
+				continue
+			}
+			certSigner, err := ssh.NewCertSigner(cert, signer)
+			if err == nil {
+				withCerts = append(withCerts, certSigner)
+			}
+		}
+		plain = append(plain, signer)
+	}
+	return append(withCerts, plain...)
+}
+
+func isCertType(keyType string) bool {
+	return strings.HasSuffix(keyType, "-cert-v01@openssh.com")
+}
+
+// LoadCertAuthorities parses host CA keys. Each entry is either an
+// authorized_keys style line or a path to a file containing such lines.
+// @cert-authority entries matching host in the knownHosts files are
+// included.
+func LoadCertAuthorities(entries, knownHosts []string, host string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		data := []byte(entry)
+		if !strings.Contains(entry, " ") {
+			path, err := expandHome(entry)
+			if err != nil {
+				return nil, err
+			}
+			if data, err = os.ReadFile(path); err != nil {
+				return nil, fmt.Errorf("read cert authority: %w", err)
+			}
+		}
+		parsed, err := parseAuthorizedKeys(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse cert authority %q: %w", entry, err)
+		}
+		keys = append(keys, parsed...)
+	}
+
+	for _, file := range knownHosts {
+		known, err := knownHostAuthorities(file, host)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, known...)
+	}
+	return keys, nil
+}
+
+func parseAuthorizedKeys(data []byte) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		pub, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, pub)
+		data = rest
+	}
+	return keys, nil
+}
+
+// knownHostAuthorities returns the @cert-authority keys in file that apply
+// to host. A missing file has none.
+func knownHostAuthorities(file, host string) ([]ssh.PublicKey, error) {
+	path, err := expandHome(file)
+	if err != nil {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var keys []ssh.PublicKey
+	for {
+		marker, hosts, pub, _, rest, err := ssh.ParseKnownHosts(data)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Skip the malformed line; ParseKnownHosts does not say where it ended.
+			next := bytes.IndexByte(data, '\n')
+			if next < 0 {
+				break
+			}
+			data = data[next+1:]
+			continue
+		}
+		data = rest
+		if marker == "cert-authority" && sshconfig.MatchPatterns(hosts, host) {
+			keys = append(keys, pub)
+		}
+	}
+	return keys, nil
+}
+
+// HostCertCallback returns a host key callback that accepts host
+// certificates signed by one of authorities and hands plain host keys to
+// fallback, along with the certificate algorithms to request from the
+// server.
+func HostCertCallback(authorities []ssh.PublicKey, fallback ssh.HostKeyCallback) (ssh.HostKeyCallback, []string) {
+	checker := &ssh.CertChecker{
+		HostKeyFallback: fallback,
+		IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+			return isAuthority(authorities, auth)
+		},
+	}
+	return checker.CheckHostKey, hostCertAlgorithms
+}
+
+func isAuthority(authorities []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, ca := range authorities {
+		if bytes.Equal(ca.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostKeyAddress formats a node name the way ssh.CertChecker expects, so the
+// node name is checked against the certificate principals.
+func HostKeyAddress(node string) string {
+	return net.JoinHostPort(node, "22")
+}
+
+func expandHome(path string) (string, error) {
+	if strings.HasPrefix(path, "~") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, strings.TrimPrefix(path, "~")), nil
+	}
+	return path, nil
+}
@@ -0,0 +1,209 @@
+package sshutil
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// StrictHostKeyChecking values, as in ssh_config(5).
+const (
+	StrictYes       = "yes"
+	StrictAcceptNew = "accept-new"
+	StrictNo        = "no"
+	StrictAsk       = "ask"
+)
+
+// DefaultUserKnownHostsFiles and DefaultGlobalKnownHostsFiles are used when
+// ssh_config does not name any.
+var (
+	DefaultUserKnownHostsFiles   = []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts2"}
+	DefaultGlobalKnownHostsFiles = []string{"/etc/ssh/ssh_known_hosts", "/etc/ssh/ssh_known_hosts2"}
+)
+
+// HostKeyChecker verifies host keys against host certificate authorities or
+// known_hosts files, and remembers whether the key presented was verified.
+// Password authentication and agent forwarding should only be used once
+// Verified reports true.
+type HostKeyChecker struct {
+	// Authorities accept host certificates signed by one of them. Plain host
+	// keys are still checked against the known_hosts files.
+	Authorities []ssh.PublicKey
+	// UserFiles are searched for the host's key; new keys are added to the
+	// first one. GlobalFiles are only searched.
+	UserFiles   []string
+	GlobalFiles []string
+	// Strict is the StrictHostKeyChecking mode; empty means StrictAsk.
+	Strict string
+	// Confirm asks whether to trust an unknown key in StrictAsk mode.
+	Confirm func(prompt string) (bool, error)
+
+	verified atomic.Bool
+}
+
+// Verified reports whether the host presented a known or trusted key.
+func (c *HostKeyChecker) Verified() bool {
+	return c.verified.Load()
+}
+
+// Callback returns the host key callback for host along with the host key
+// algorithms to request, which are nil when any algorithm will do.
+func (c *HostKeyChecker) Callback(host string) (ssh.HostKeyCallback, []string, error) {
+	known, algorithms, err := c.knownHosts(host)
+	if err != nil || len(c.Authorities) == 0 {
+		return known, algorithms, err
+	}
+	check, certAlgorithms := HostCertCallback(c.Authorities, known)
+	if algorithms != nil {
+		// Prefer a certificate, but accept the keys already pinned.
+		algorithms = append(certAlgorithms, algorithms...)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := check(hostname, remote, key); err != nil {
+			return err
+		}
+		// Plain keys were judged by the known_hosts callback.
+		if _, ok := key.(*ssh.Certificate); ok {
+			c.verified.Store(true)
+		}
+		return nil
+	}, algorithms, nil
+}
+
+// knownHosts returns the callback checking plain host keys against the
+// known_hosts files, and the key algorithms known for host.
+func (c *HostKeyChecker) knownHosts(host string) (ssh.HostKeyCallback, []string, error) {
+	var files []string
+	for _, file := range append(append([]string{}, c.UserFiles...), c.GlobalFiles...) {
+		path, err := expandHome(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	known, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known(hostname, remote, key)
+		if err == nil {
+			c.verified.Store(true)
+			return nil
+		}
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if want := c.pinned(keyErr.Want); len(want) > 0 {
+			return fmt.Errorf("host key for %s has changed (%s key %s; known at %s:%d); remove the old entry if the change is expected",
+				host, key.Type(), ssh.FingerprintSHA256(key), want[0].Filename, want[0].Line)
+		}
+		return c.unknown(host, hostname, key)
+	}, c.knownAlgorithms(known, HostKeyAddress(host)), nil
+}
+
+// pinned drops the @cert-authority entries, which knownhosts reports along
+// with the host's own keys, from want.
+func (c *HostKeyChecker) pinned(want []knownhosts.KnownKey) []knownhosts.KnownKey {
+	var keys []knownhosts.KnownKey
+	for _, k := range want {
+		if !isAuthority(c.Authorities, k.Key) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// unknown decides on a key that is in no known_hosts file.
+func (c *HostKeyChecker) unknown(host, address string, key ssh.PublicKey) error {
+	switch strings.ToLower(c.Strict) {
+	case StrictYes:
+		return fmt.Errorf("no %s host key is known for %s and StrictHostKeyChecking is yes", key.Type(), host)
+	case StrictNo, "off":
+		// Accepted, but not trusted with passwords or the agent.
+		return nil
+	case StrictAcceptNew:
+	default:
+		if c.Confirm == nil {
+			return fmt.Errorf("host key verification failed for %s", host)
+		}
+		ok, err := c.Confirm(fmt.Sprintf("The authenticity of host '%s' can't be established.\n%s key fingerprint is %s.\nAre you sure you want to continue connecting (yes/no)? ",
+			host, key.Type(), ssh.FingerprintSHA256(key)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("host key verification failed for %s", host)
+		}
+	}
+	if err := c.add(address, key); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to add the host to the list of known hosts: %v\n", err)
+	} else {
+		fmt.Fprintf(os.Stderr, "Permanently added '%s' (%s) to the list of known hosts.\n", host, key.Type())
+	}
+	c.verified.Store(true)
+	return nil
+}
+
+// add appends key for address to the first user known_hosts file.
+func (c *HostKeyChecker) add(address string, key ssh.PublicKey) error {
+	if len(c.UserFiles) == 0 {
+		return errors.New("no UserKnownHostsFile")
+	}
+	path, err := expandHome(c.UserFiles[0])
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{address}, key)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// knownAlgorithms returns the key types known for address, so the server
+// is asked for a key that can be checked. It probes the callback with a key
+// that cannot match and reads the wanted keys from the error.
+func (c *HostKeyChecker) knownAlgorithms(known ssh.HostKeyCallback, address string) []string {
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if err := known(address, &net.TCPAddr{}, probe); !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	seen := map[string]bool{}
+	for _, want := range c.pinned(keyErr.Want) {
+		types := []string{want.Key.Type()}
+		if types[0] == ssh.KeyAlgoRSA {
+			types = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, t := range types {
+			if !seen[t] {
+				seen[t] = true
+				algorithms = append(algorithms, t)
+			}
+		}
+	}
+	return algorithms
+}
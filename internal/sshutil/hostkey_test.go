@@ -0,0 +1,93 @@
+package sshutil
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func hostCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, principal string) *ssh.Certificate {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{principal},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestHostKeyCheckerWithAuthorities(t *testing.T) {
+	ca, pinned, other := newSigner(t), newSigner(t), newSigner(t)
+	dir := t.TempDir()
+	user := filepath.Join(dir, "known_hosts")
+	global := filepath.Join(dir, "ssh_known_hosts")
+	writeFile(t, user, knownhosts.Line([]string{"web-1"}, pinned.PublicKey())+"\n")
+	writeFile(t, global, "@cert-authority * "+string(ssh.MarshalAuthorizedKey(ca.PublicKey())))
+
+	tests := []struct {
+		name         string
+		host         string
+		key          ssh.PublicKey
+		wantErr      bool
+		wantVerified bool
+	}{
+		{"certificate", "db-1", hostCert(t, ca, other.PublicKey(), "db-1"), false, true},
+		{"certificate for another host", "db-1", hostCert(t, ca, other.PublicKey(), "db-2"), true, false},
+		{"pinned plain key", "web-1", pinned.PublicKey(), false, true},
+		{"changed plain key", "web-1", other.PublicKey(), true, false},
+		{"unknown plain key", "db-1", other.PublicKey(), true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authorities, err := LoadCertAuthorities(nil, []string{user, global}, tt.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(authorities) != 1 {
+				t.Fatalf("loaded %d authorities, want 1", len(authorities))
+			}
+			c := &HostKeyChecker{Authorities: authorities, UserFiles: []string{user}, GlobalFiles: []string{global}, Strict: StrictYes}
+			callback, _, err := c.Callback(tt.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = callback(HostKeyAddress(tt.host), &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if c.Verified() != tt.wantVerified {
+				t.Errorf("Verified() = %v, want %v", c.Verified(), tt.wantVerified)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -26,6 +26,16 @@ func (b *BufferedConn) Read(p []byte) (int, error) {
 	return b.reader.Read(p)
 }
 
+// Peek returns the next n bytes without consuming them.
+func (b *BufferedConn) Peek(n int) ([]byte, error) {
+	return b.reader.Peek(n)
+}
+
+// ReadString reads up to and including delim through the buffer.
+func (b *BufferedConn) ReadString(delim byte) (string, error) {
+	return b.reader.ReadString(delim)
+}
+
 // CloseWrite closes the write side of the underlying connection if possible.
 func (b *BufferedConn) CloseWrite() error {
 	if cw, ok := b.Conn.(interface{ CloseWrite() error }); ok {
@@ -6,23 +6,49 @@ import (
 	"sync"
 )
 
+// Stats summarizes a finished Pipe.
+type Stats struct {
+	// AToB and BToA count the bytes copied in each direction.
+	AToB, BToA int64
+	// ClosedByB reports that b finished sending before a did.
+	ClosedByB bool
+	// Err is the first copy error other than a clean EOF.
+	Err error
+}
+
 // Pipe forwards bytes in both directions until both sides close.
-func Pipe(a, b net.Conn) {
-	var wg sync.WaitGroup
-	copy := func(dst, src net.Conn) {
+func Pipe(a, b net.Conn) Stats {
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		stats Stats
+		first = true
+	)
+	copy := func(dst, src net.Conn, n *int64, fromB bool) {
 		defer wg.Done()
-		_, _ = io.Copy(dst, src)
+		written, err := io.Copy(dst, src)
 		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
 			_ = cw.CloseWrite()
 		} else {
 			_ = dst.Close()
 		}
+		mu.Lock()
+		*n = written
+		if first {
+			first = false
+			stats.ClosedByB = fromB
+		}
+		if err != nil && stats.Err == nil {
+			stats.Err = err
+		}
+		mu.Unlock()
 	}
 
 	wg.Add(2)
-	go copy(a, b)
-	go copy(b, a)
+	go copy(a, b, &stats.BToA, true)
+	go copy(b, a, &stats.AToB, false)
 	wg.Wait()
 	_ = a.Close()
 	_ = b.Close()
+	return stats
 }
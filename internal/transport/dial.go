@@ -0,0 +1,99 @@
+// Package transport opens connections to the rendezvous server.
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/eznix86/mssh/internal/logging"
+)
+
+// TLSOptions configures TLS towards the rendezvous server (or a TLS proxy
+// such as nginx or Caddy in front of it).
+type TLSOptions struct {
+	Enabled bool
+	// CA is a PEM bundle used instead of the system roots.
+	CA string
+	// Cert and Key are an optional client certificate for mutual TLS.
+	Cert string
+	Key  string
+	// ServerName overrides the name used for SNI and verification.
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// Dial connects to host:port, wrapping the connection in TLS when enabled.
+func Dial(host string, port int, opts TLSOptions) (net.Conn, error) {
+	return DialWith(&net.Dialer{}, host, port, opts)
+}
+
+// DialWith is Dial using dialer, e.g. to connect from a given local port.
+func DialWith(dialer *net.Dialer, host string, port int, opts TLSOptions) (net.Conn, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if !opts.Enabled {
+		return dialer.Dial("tcp", addr)
+	}
+	cfg, err := opts.Config(host)
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, cfg)
+}
+
+// warnedPlaintext holds the servers WarnPlaintextToken has warned about.
+var warnedPlaintext sync.Map
+
+// WarnPlaintextToken logs a warning, once per server, when a token is about
+// to be sent without TLS. QUIC always uses TLS; WebSocket URLs use it for
+// wss://, other connections when opts.Enabled is set.
+func WarnPlaintextToken(server, webSocket string, quic bool, opts TLSOptions) {
+	secure := quic || opts.Enabled
+	if webSocket != "" {
+		secure = strings.HasPrefix(webSocket, "wss://")
+	}
+	if secure {
+		return
+	}
+	if _, warned := warnedPlaintext.LoadOrStore(server, true); warned {
+		return
+	}
+	logging.Component("transport").Warn("sending token without TLS; enable tls to keep it private",
+		logging.KeyServer, server)
+}
+
+// Config builds a client tls.Config for connecting to host.
+func (o TLSOptions) Config(host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         host,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.ServerName != "" {
+		cfg.ServerName = o.ServerName
+	}
+	if o.CA != "" {
+		pem, err := os.ReadFile(o.CA)
+		if err != nil {
+			return nil, fmt.Errorf("read TLS CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CA)
+		}
+		cfg.RootCAs = pool
+	}
+	if o.Cert != "" || o.Key != "" {
+		pair, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,275 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICScheme prefixes server addresses reached over QUIC, as in
+// quic://rendezvous.example.com:8443.
+const QUICScheme = "quic://"
+
+// quicALPN is the application protocol negotiated on QUIC connections.
+const quicALPN = "mssh"
+
+// quicConfig keeps agent connections alive while only their control stream
+// is open, and leaves room for many concurrent sessions per connection.
+var quicConfig = &quic.Config{
+	KeepAlivePeriod:    15 * time.Second,
+	MaxIncomingStreams: 10000,
+}
+
+// SplitScheme strips QUICScheme from a server address and reports whether
+// it was present.
+func SplitScheme(addr string) (string, bool) {
+	if rest, ok := strings.CutPrefix(addr, QUICScheme); ok {
+		return rest, true
+	}
+	return addr, false
+}
+
+// StreamConn is one QUIC stream presented as a net.Conn, so the handshake
+// and stream.Pipe work on it as on TCP.
+type StreamConn struct {
+	*quic.Stream
+	conn *quic.Conn
+	// release drops a dialed stream's hold on its shared connection.
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *StreamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *StreamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// CloseWrite ends the sending side, like a TCP half-close.
+func (c *StreamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+// Read treats the peer closing the whole connection without an error as the
+// end of the stream, as a dialing process does when it exits.
+func (c *StreamConn) Read(p []byte) (int, error) {
+	n, err := c.Stream.Read(p)
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close ends both directions of the stream. A dialed connection is closed
+// along with its last stream; otherwise it stays open for other streams.
+func (c *StreamConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.Stream.CancelRead(0)
+		err = c.Stream.Close()
+		if c.release != nil {
+			c.release()
+		}
+	})
+	return err
+}
+
+// ConnectionState returns the TLS state of the connection, including the
+// peer certificates.
+func (c *StreamConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// quicDialTimeout bounds dialing a server and opening a stream on it.
+const quicDialTimeout = 30 * time.Second
+
+// dialedConn is a cached client connection and the number of its streams
+// still open or being opened.
+type dialedConn struct {
+	// ready is closed once the dial finished and conn or err is set.
+	ready   chan struct{}
+	conn    *quic.Conn
+	err     error
+	streams int
+}
+
+var (
+	quicMu    sync.Mutex
+	quicConns = map[string]*dialedConn{}
+)
+
+// DialQUIC opens a stream to host:port over QUIC. Streams to the same
+// server share one connection, which is closed with its last stream and
+// dialed again when needed. QUIC always uses TLS; opts.Enabled is ignored.
+func DialQUIC(host string, port int, opts TLSOptions) (net.Conn, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	key := fmt.Sprintf("%s %#v", addr, opts)
+	for {
+		dc, fresh, err := sharedConn(key, host, addr, opts)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), quicDialTimeout)
+		stream, err := dc.conn.OpenStreamSync(ctx)
+		cancel()
+		if err == nil {
+			return &StreamConn{Stream: stream, conn: dc.conn, release: func() { dc.release(key) }}, nil
+		}
+		// The connection is broken; the next stream gets a new one.
+		quicMu.Lock()
+		if quicConns[key] == dc {
+			delete(quicConns, key)
+		}
+		quicMu.Unlock()
+		dc.conn.CloseWithError(0, "")
+		dc.release(key)
+		if fresh {
+			return nil, err
+		}
+	}
+}
+
+// sharedConn returns the connection for key with a stream reserved on it,
+// and whether it was dialed for this call. Only one dial per key runs at a
+// time; other callers wait for it without holding quicMu.
+func sharedConn(key, host, addr string, opts TLSOptions) (*dialedConn, bool, error) {
+	quicMu.Lock()
+	dc, ok := quicConns[key]
+	if !ok {
+		dc = &dialedConn{ready: make(chan struct{})}
+		quicConns[key] = dc
+	}
+	dc.streams++
+	quicMu.Unlock()
+
+	if !ok {
+		conn, err := dialQUIC(host, addr, opts)
+		quicMu.Lock()
+		dc.conn, dc.err = conn, err
+		if err != nil && quicConns[key] == dc {
+			delete(quicConns, key)
+		}
+		quicMu.Unlock()
+		close(dc.ready)
+	}
+	<-dc.ready
+	if dc.err != nil {
+		dc.release(key)
+		return nil, false, dc.err
+	}
+	return dc, !ok, nil
+}
+
+func dialQUIC(host, addr string, opts TLSOptions) (*quic.Conn, error) {
+	cfg, err := opts.Config(host)
+	if err != nil {
+		return nil, err
+	}
+	cfg.NextProtos = []string{quicALPN}
+	ctx, cancel := context.WithTimeout(context.Background(), quicDialTimeout)
+	defer cancel()
+	return quic.DialAddr(ctx, addr, cfg, quicConfig)
+}
+
+// release drops one stream's hold on dc, closing the connection with its
+// last stream.
+func (dc *dialedConn) release(key string) {
+	quicMu.Lock()
+	defer quicMu.Unlock()
+	if dc.streams--; dc.streams > 0 {
+		return
+	}
+	if quicConns[key] == dc {
+		delete(quicConns, key)
+	}
+	if dc.conn != nil {
+		dc.conn.CloseWithError(0, "")
+	}
+}
+
+// quicListener accepts the streams of all connections to a QUIC listener
+// as net.Conns.
+type quicListener struct {
+	ln      *quic.Listener
+	streams chan net.Conn
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// ListenQUIC listens for QUIC connections on addr. config is called for
+// every new connection, so certificates can be replaced while listening.
+func ListenQUIC(addr string, config func() *tls.Config) (net.Listener, error) {
+	base := &tls.Config{
+		NextProtos: []string{quicALPN},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := config()
+			if cfg == nil {
+				return nil, fmt.Errorf("no TLS config")
+			}
+			cfg = cfg.Clone()
+			cfg.NextProtos = []string{quicALPN}
+			return cfg, nil
+		},
+	}
+	ln, err := quic.ListenAddr(addr, base, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &quicListener{ln: ln, streams: make(chan net.Conn), ctx: ctx, cancel: cancel}
+	go l.acceptConns()
+	return l, nil
+}
+
+func (l *quicListener) acceptConns() {
+	for {
+		conn, err := l.ln.Accept(l.ctx)
+		if err != nil {
+			return
+		}
+		go l.acceptStreams(conn)
+	}
+}
+
+func (l *quicListener) acceptStreams(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(l.ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- &StreamConn{Stream: stream, conn: conn}:
+		case <-l.ctx.Done():
+			stream.CancelRead(0)
+			stream.Close()
+			return
+		}
+	}
+}
+
+// Accept returns the next stream opened by any peer.
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.streams:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening and closes all connections.
+func (l *quicListener) Close() error {
+	l.cancel()
+	return l.ln.Close()
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
@@ -0,0 +1,596 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket URL schemes for server addresses, as in
+// wss://rendezvous.example.com/mssh. wss:// always uses TLS.
+const (
+	WSScheme  = "ws://"
+	WSSScheme = "wss://"
+)
+
+// wsGUID is appended to the client's key to compute Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsPingInterval keeps idle connections, such as an agent's control
+// channel, from being dropped by HTTP proxies.
+const wsPingInterval = 30 * time.Second
+
+// Frame opcodes (RFC 6455, section 5.2).
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// SplitWebSocket parses a ws:// or wss:// server address. It returns the URL
+// to dial and the server's host:port, filling in the default HTTP port. Other
+// addresses are returned unchanged with an empty URL.
+func SplitWebSocket(addr string) (string, string, error) {
+	if !strings.HasPrefix(addr, WSScheme) && !strings.HasPrefix(addr, WSSScheme) {
+		return "", addr, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Hostname() == "" {
+		return "", "", fmt.Errorf("missing host in %q", addr)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	return u.String(), net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// wsConn carries a byte stream in binary WebSocket messages. CloseWrite
+// sends a close frame and Read reports the peer's close frame as io.EOF, so
+// the closing handshake works like a TCP half-close.
+type wsConn struct {
+	// Conn is the underlying connection, for deadlines and addresses.
+	net.Conn
+	r      *bufio.Reader
+	w      io.Writer
+	closer io.Closer
+	// client masks outgoing frames, as RFC 6455 requires of clients.
+	client bool
+	state  *tls.ConnectionState
+	// remote is the client address forwarded by a trusted proxy.
+	remote net.Addr
+
+	// remaining is the unread payload of the current data frame.
+	remaining int64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	eof       bool
+
+	wmu       sync.Mutex
+	closeSent bool
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newWSConn(conn net.Conn, r *bufio.Reader, w io.Writer, closer io.Closer, client bool) *wsConn {
+	return &wsConn{Conn: conn, r: r, w: w, closer: closer, client: client, done: make(chan struct{})}
+}
+
+// RemoteAddr returns the client address forwarded by a trusted proxy, if
+// any, or else the peer of the underlying connection.
+func (c *wsConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// Read returns the payload of data frames. Header bytes are only consumed
+// once complete, so a read deadline can interrupt it safely.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	if c.masked {
+		for i := range p[:n] {
+			p[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// nextFrame reads a frame header, handling control frames itself.
+func (c *wsConn) nextFrame() error {
+	head, err := c.r.Peek(2)
+	if err != nil {
+		return err
+	}
+	opcode := head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	size := int64(head[1] & 0x7f)
+	n := 2
+	switch size {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if masked {
+		n += 4
+	}
+	if head, err = c.r.Peek(n); err != nil {
+		return err
+	}
+	switch size {
+	case 126:
+		size = int64(binary.BigEndian.Uint16(head[2:]))
+	case 127:
+		size = int64(binary.BigEndian.Uint64(head[2:]))
+	}
+	if size < 0 {
+		return errors.New("websocket: invalid frame length")
+	}
+	var mask [4]byte
+	if masked {
+		copy(mask[:], head[n-4:])
+	}
+
+	if opcode >= opClose {
+		if size > 125 {
+			return errors.New("websocket: control frame too long")
+		}
+		frame, err := c.r.Peek(n + int(size))
+		if err != nil {
+			return err
+		}
+		payload := append([]byte(nil), frame[n:]...)
+		c.r.Discard(n + int(size))
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch opcode {
+		case opClose:
+			c.eof = true
+		case opPing:
+			c.writeFrame(opPong, payload)
+		}
+		return nil
+	}
+	switch opcode {
+	case opContinuation, opText, opBinary:
+	default:
+		return fmt.Errorf("websocket: unknown opcode %d", opcode)
+	}
+	c.r.Discard(n)
+	c.remaining, c.mask, c.masked, c.maskPos = size, mask, masked, 0
+	return nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends one unfragmented frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	if _, err := c.w.Write(frame); err != nil {
+		return err
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+	return nil
+}
+
+// CloseWrite sends a normal close frame; the peer reads it as EOF.
+func (c *wsConn) CloseWrite() error {
+	return c.writeFrame(opClose, binary.BigEndian.AppendUint16(nil, 1000))
+}
+
+// Close ends the stream in both directions.
+func (c *wsConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.CloseWrite()
+		err = c.closer.Close()
+	})
+	return err
+}
+
+// ConnectionState returns the TLS state of the HTTP connection the
+// WebSocket was upgraded from, if any.
+func (c *wsConn) ConnectionState() tls.ConnectionState {
+	if c.state == nil {
+		return tls.ConnectionState{}
+	}
+	return *c.state
+}
+
+// ping sends pings until the connection is closed.
+func (c *wsConn) ping() {
+	t := time.NewTicker(wsPingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			if c.writeFrame(opPing, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// DialWebSocket upgrades an HTTP connection to rawURL and returns it as a
+// net.Conn carrying binary messages. The HTTP(S)_PROXY environment variables
+// are honored; the upgrade always goes through a CONNECT tunnel, since many
+// proxies do not pass it on for a plain request. opts supplies the CA, client certificate and server name for
+// wss://; whether TLS is used follows the scheme.
+func DialWebSocket(rawURL string, opts TLSOptions) (net.Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	// raw is the TCP connection under the upgrade, which may lead to a
+	// proxy; it provides deadlines and addresses.
+	var raw net.Conn
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			raw = conn
+			return conn, err
+		},
+		TLSHandshakeTimeout: 30 * time.Second,
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+		// The transport only tunnels https requests; do it here for http.
+		proxy, err := http.ProxyFromEnvironment(&http.Request{URL: u})
+		if err != nil {
+			return nil, err
+		}
+		if proxy != nil {
+			tr.Proxy = nil
+			tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := connectTunnel(ctx, dialer, proxy, addr)
+				raw = conn
+				return conn, err
+			}
+		}
+	case "wss":
+		u.Scheme = "https"
+		if tr.TLSClientConfig, err = opts.Config(u.Hostname()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		resp.Body.Close()
+		return nil, fmt.Errorf("websocket upgrade refused: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		body.Close()
+		return nil, errors.New("websocket upgrade: invalid Sec-WebSocket-Accept")
+	}
+	c := newWSConn(raw, bufio.NewReader(body), body, body, true)
+	go c.ping()
+	return c, nil
+}
+
+// connectTunnel opens a connection to addr through a CONNECT request to the
+// HTTP proxy at proxy.
+func connectTunnel(ctx context.Context, dialer *net.Dialer, proxy *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		port := "80"
+		if proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), port)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s: %w", proxyAddr, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxyAddr, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxyAddr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused the tunnel: %s", proxyAddr, resp.Status)
+	}
+	// Nothing was sent through the tunnel yet, so nothing can be buffered.
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: unexpected data after CONNECT response", proxyAddr)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsListener accepts WebSocket upgrades on one path and yields them as
+// net.Conns.
+type wsListener struct {
+	ln   net.Listener
+	srv  *http.Server
+	path string
+	// trusted are the proxies whose X-Forwarded-For header is believed.
+	trusted []netip.Prefix
+	conns   chan net.Conn
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// ListenWebSocket serves HTTP on addr and accepts WebSocket upgrades at path;
+// other paths get 404. Upgrades from a trusted proxy report the client
+// named in X-Forwarded-For as their remote address. config is called for
+// every new connection, so certificates can be replaced while listening;
+// when it returns nil, the listener speaks plain HTTP.
+func ListenWebSocket(addr, path string, trusted []netip.Prefix, config func() *tls.Config) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &wsListener{ln: ln, path: path, trusted: trusted, conns: make(chan net.Conn), ctx: ctx, cancel: cancel}
+	l.srv = &http.Server{Handler: l, ReadHeaderTimeout: 30 * time.Second}
+	go l.srv.Serve(&tlsListener{Listener: ln, config: config})
+	return l, nil
+}
+
+// ServeHTTP completes the upgrade and hands the connection to Accept.
+func (l *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != l.path {
+		http.NotFound(w, r)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", acceptKey(key))
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	c := newWSConn(conn, brw.Reader, conn, conn, false)
+	c.state = r.TLS
+	c.remote = forwardedFor(conn.RemoteAddr(), r.Header, l.trusted)
+	select {
+	case l.conns <- c:
+	case <-l.ctx.Done():
+		c.Close()
+	}
+}
+
+// forwardedFor returns the client behind trusted proxies: the rightmost
+// X-Forwarded-For entry that is not itself a trusted proxy. It returns nil
+// when peer is not trusted or names no client. The client's port is not
+// forwarded and is reported as 0.
+func forwardedFor(peer net.Addr, h http.Header, trusted []netip.Prefix) net.Addr {
+	addrPort, err := netip.ParseAddrPort(peer.String())
+	if err != nil || !isTrusted(addrPort.Addr(), trusted) {
+		return nil
+	}
+	var hops []string
+	for _, value := range h.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = hop
+		if !isTrusted(hop, trusted) {
+			break
+		}
+	}
+	if !client.IsValid() {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(client.Unmap(), 0))
+}
+
+func isTrusted(ip netip.Addr, trusted []netip.Prefix) bool {
+	ip = ip.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerHas reports whether the comma-separated header name lists token.
+func headerHas(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Accept returns the next upgraded connection.
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening. Upgraded connections stay open.
+func (l *wsListener) Close() error {
+	l.cancel()
+	return l.srv.Close()
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// tlsListener starts TLS on accepted connections when config returns one.
+type tlsListener struct {
+	net.Listener
+	config func() *tls.Config
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if cfg := l.config(); cfg != nil {
+		return tls.Server(conn, cfg), nil
+	}
+	return conn, nil
+}